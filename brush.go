@@ -0,0 +1,243 @@
+// Package brush is a compiler for the Braai templating language. It wraps the
+// lower-level parse package with a Template type and a Scope-based handler
+// model, so that applications can render Braai documents without dealing with
+// the AST directly.
+package brush
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/timraymond/brush/parse"
+)
+
+// A SyntaxError reports a problem found while lexing or parsing a Template
+type SyntaxError = parse.SyntaxError
+
+// An UndefinedHandlerError reports a tag without a handler
+type UndefinedHandlerError = parse.UndefinedHandlerError
+
+// A SchemaError reports a tag which does not conform to its TagSchema
+type SchemaError = parse.SchemaError
+
+// A HandlerError wraps an error returned by the handler of a tag
+type HandlerError = parse.HandlerError
+
+// An ErrorList holds every problem found by Template.Validate, or by Parse
+// when the Template recovers from malformed tags
+type ErrorList = parse.ErrorList
+
+// A Position locates an error, or a node of the AST, within a Template
+type Position = parse.Position
+
+// A Template is a Braai document. It must be parsed before it can be
+// executed.
+type Template struct {
+	name       string
+	text       string
+	leftDelim  string
+	rightDelim string
+	recovering bool
+	lossless   bool
+	root       parse.Node
+}
+
+// New returns an unparsed Template for the given Braai document
+func New(text string) *Template {
+	return NewNamed("brush", text)
+}
+
+// NewNamed returns an unparsed Template whose name will be used when reporting
+// the position of errors
+func NewNamed(name, text string) *Template {
+	return &Template{name: name, text: text}
+}
+
+// Name returns the name of the Template
+func (t *Template) Name() string {
+	return t.name
+}
+
+// Delims sets the delimiters used to recognize Braai tags, such as "[[" and
+// "]]". An empty delimiter is replaced by its default, "{{" or "}}".
+func (t *Template) Delims(left, right string) *Template {
+	t.leftDelim = left
+	t.rightDelim = right
+	return t
+}
+
+// Recover causes Parse to continue past malformed tags. The Template will be
+// usable even if Parse returns an error, which will be an ErrorList of
+// every problem encountered. Malformed tags render as the placeholder
+// registered with HandleMux.ErrorPlaceholder.
+func (t *Template) Recover() *Template {
+	t.recovering = true
+	return t
+}
+
+// Lossless causes Parse to retain the source of every tag, so that Print
+// reproduces the document byte-for-byte, apart from any tags modified through
+// Root. See parse.Source for details.
+func (t *Template) Lossless() *Template {
+	t.lossless = true
+	return t
+}
+
+// Parse transforms the document into an AST, returning the Template so that
+// calls can be chained. Any identifiers passed as blockTags will be treated as
+// block tags, which is most easily done with HandleMux.BlockHandlers(). The
+// HTML context of every tag is determined using parse.AnalyzeEscaping, so
+// that its output can be escaped accordingly.
+func (t *Template) Parse(blockTags ...string) (*Template, error) {
+	tree := parse.New(t.name, t.text, blockTags).Delims(t.leftDelim, t.rightDelim)
+	if t.recovering {
+		tree.Recover()
+	}
+	if t.lossless {
+		tree.Lossless()
+	}
+	root, err := tree.Parse()
+	if err != nil && (!t.recovering || root == nil) {
+		return nil, err
+	}
+	parse.AnalyzeEscaping(root)
+	t.root = root
+	return t, err
+}
+
+// A Node is a node of the AST of a Template. The nodes of an AST, such as
+// BraaiTagNode and BlockTagNode, are described by the parse package.
+type Node = parse.Node
+
+// A DocumentNode is the root of an AST, or the Subtree of a block tag
+type DocumentNode = parse.DocumentNode
+
+// An ErrorNode marks a malformed region of a Template parsed with Recover
+type ErrorNode = parse.ErrorNode
+
+// A BraaiTagNode is a Braai tag, such as {{product(42).name size="big"}}
+type BraaiTagNode = parse.BraaiTagNode
+
+// A BlockTagNode is a block tag, along with the Subtree of nodes within it
+type BlockTagNode = parse.BlockTagNode
+
+// A TextNode is text outside of any Braai tag
+type TextNode = parse.TextNode
+
+// Root returns the AST of a parsed Template, or nil if the Template has not
+// been parsed yet
+func (t *Template) Root() Node {
+	return t.root
+}
+
+// Print writes the parsed Template to w as canonical Braai source, using the
+// delimiters of the Template; see parse.Printer for details
+func (t *Template) Print(w io.Writer) error {
+	if t.root == nil {
+		return fmt.Errorf("brush: template %s has not been parsed", t.name)
+	}
+	return (&parse.Printer{LeftDelim: t.leftDelim, RightDelim: t.rightDelim}).Print(w, t.root)
+}
+
+// A RewriteFunc is called by Template.Rewrite for every Node of the AST,
+// returning the Node to put in its place and the Action to take
+type RewriteFunc = parse.RewriteFunc
+
+// An Action tells Template.Rewrite what to do with a Node
+type Action = parse.Action
+
+// The Actions a RewriteFunc may return
+const (
+	Continue     = parse.Continue     // replace the node with the one returned, and rewrite the nodes within it
+	Skip         = parse.Skip         // replace the node with the one returned, leaving the nodes within it alone
+	Delete       = parse.Delete       // remove the node, ignoring the one returned
+	InsertBefore = parse.InsertBefore // insert the returned node before this one, which is kept and rewritten
+	InsertAfter  = parse.InsertAfter  // insert the returned node after this one, which is kept and rewritten
+)
+
+// Rewrite transforms the AST of the parsed Template by applying fn to every
+// node, as described by parse.Rewrite, and then determines the HTML context
+// of every tag afresh
+func (t *Template) Rewrite(fn RewriteFunc) error {
+	if t.root == nil {
+		return fmt.Errorf("brush: template %s has not been parsed", t.name)
+	}
+	if t.root = parse.Rewrite(t.root, fn); t.root == nil {
+		t.root = &parse.DocumentNode{NodeList: make([]parse.Node, 0)}
+	}
+	parse.AnalyzeEscaping(t.root)
+	return nil
+}
+
+// Execute renders the parsed Template using the handlers registered with mux
+func (t *Template) Execute(mux *HandleMux) (string, error) {
+	return t.ExecuteContext(context.Background(), mux)
+}
+
+// ExecuteContext is like Execute, but passes ctx to the handlers registered
+// with HandleContext, HandleBlockContext and the stream variants. Execution is
+// abandoned with the error of ctx once it is cancelled.
+func (t *Template) ExecuteContext(ctx context.Context, mux *HandleMux) (string, error) {
+	if t.root == nil {
+		return "", fmt.Errorf("brush: template %s has not been parsed", t.name)
+	}
+	return t.root.ExecuteContext(ctx, mux.mux)
+}
+
+// A ConcurrentExecutor executes the tags of a Template in parallel, with at
+// most Workers at once. See parse.ConcurrentExecutor for details.
+type ConcurrentExecutor = parse.ConcurrentExecutor
+
+// ExecuteConcurrent is like ExecuteContext, but executes the tags of the
+// Template in parallel using e. The output is still assembled in document
+// order. Handlers must be safe for concurrent use.
+func (t *Template) ExecuteConcurrent(ctx context.Context, e *ConcurrentExecutor, mux *HandleMux) (string, error) {
+	if t.root == nil {
+		return "", fmt.Errorf("brush: template %s has not been parsed", t.name)
+	}
+	return e.Execute(ctx, t.root, mux.mux)
+}
+
+// Validate checks every tag in the parsed Template against the handlers
+// registered with mux, without executing it. Every problem found is reported
+// in an ErrorList; see parse.Validate for details.
+func (t *Template) Validate(mux *HandleMux) error {
+	if t.root == nil {
+		return fmt.Errorf("brush: template %s has not been parsed", t.name)
+	}
+	return parse.Validate(t.root, mux.mux)
+}
+
+// Prefetch invokes the batch loaders registered with HandleMux.HandleBatch
+// once for each tag, with the keys needed by every occurrence of the tag in the
+// Template. The returned Context carries the loaded values, which handlers
+// retrieve using Loaded once the Template is executed with it.
+func (t *Template) Prefetch(ctx context.Context, mux *HandleMux) (context.Context, error) {
+	if t.root == nil {
+		return ctx, fmt.Errorf("brush: template %s has not been parsed", t.name)
+	}
+	return parse.Prefetch(ctx, t.root, mux.mux)
+}
+
+// Loaded returns the value loaded by Template.Prefetch for key, on behalf of
+// the tag named ident
+func Loaded(ctx context.Context, ident, key string) (interface{}, bool) {
+	return parse.Loaded(ctx, ident, key)
+}
+
+// ExecuteTo renders the parsed Template to w using the handlers registered
+// with mux. Output is written as it is produced, rather than being collected
+// into a string.
+func (t *Template) ExecuteTo(w io.Writer, mux *HandleMux) error {
+	return t.ExecuteToContext(context.Background(), w, mux)
+}
+
+// ExecuteToContext is like ExecuteTo, but passes ctx to the handlers as
+// ExecuteContext does
+func (t *Template) ExecuteToContext(ctx context.Context, w io.Writer, mux *HandleMux) error {
+	if t.root == nil {
+		return fmt.Errorf("brush: template %s has not been parsed", t.name)
+	}
+	return t.root.ExecuteToContext(ctx, w, mux.mux)
+}
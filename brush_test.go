@@ -0,0 +1,470 @@
+package brush_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/timraymond/brush"
+)
+
+func Test_TemplateExecute(t *testing.T) {
+	const doc string = `A greeting: {{greeting name="tim"}}!`
+
+	mux := brush.NewHandleMux()
+	mux.Handle("greeting", func(scope brush.Scope) (string, error) {
+		return "Hello " + scope.Env["name"], nil
+	})
+
+	tmpl, err := brush.New(doc).Parse()
+	if assert.NoError(t, err) {
+		result, err := tmpl.Execute(mux)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "A greeting: Hello tim!", result)
+		}
+	}
+}
+
+func Test_TemplateBlocks(t *testing.T) {
+	const doc string = "Some {{bold}}{{word}}{{/bold}} text"
+
+	mux := brush.NewHandleMux()
+	mux.Handle("word", func(scope brush.Scope) (string, error) {
+		return "emphasized", nil
+	})
+	mux.HandleBlock("bold", func(scope brush.Scope, contents *brush.Template) (string, error) {
+		inner, err := contents.Execute(mux)
+		return "<b>" + inner + "</b>", err
+	})
+
+	tmpl, err := brush.New(doc).Parse(mux.BlockHandlers()...)
+	if assert.NoError(t, err) {
+		result, err := tmpl.Execute(mux)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Some <b>emphasized</b> text", result)
+		}
+	}
+}
+
+func Test_TemplateUnparsed(t *testing.T) {
+	_, err := brush.New("{{foo}}").Execute(brush.NewHandleMux())
+	assert.Error(t, err)
+}
+
+func Test_DotHandlers(t *testing.T) {
+	const doc string = `{{article.attachments(12345).popup}} and {{article attachment_id="12345", mode="popup"}}`
+
+	mux := brush.NewHandleMux()
+	mux.HandleDot("attachments", func(scope brush.Scope) brush.Scope {
+		scope.Env["attachment_id"] = scope.Argument
+		return scope
+	})
+	mux.HandleDot("popup", func(scope brush.Scope) brush.Scope {
+		scope.Env["mode"] = "popup"
+		return scope
+	})
+	mux.Handle("article", func(scope brush.Scope) (string, error) {
+		return scope.Env["attachment_id"] + " in a " + scope.Env["mode"], nil
+	})
+
+	tmpl, err := brush.New(doc).Parse()
+	if assert.NoError(t, err) {
+		result, err := tmpl.Execute(mux)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "12345 in a popup and 12345 in a popup", result)
+		}
+	}
+}
+
+func ExampleTemplate() {
+	mux := brush.NewHandleMux()
+	mux.Handle("product", func(scope brush.Scope) (string, error) {
+		if scope.Env["path"] == ".name" {
+			return "Acme Lazer", nil
+		}
+		return "", fmt.Errorf("I only work in conjunction with a dot handler")
+	})
+	mux.HandleDot("name", func(scope brush.Scope) brush.Scope {
+		scope.Env["path"] = ".name"
+		return scope
+	})
+
+	tmpl, _ := brush.New("This is an amazing product: {{product.name}}").Parse()
+	result, _ := tmpl.Execute(mux)
+	fmt.Println(result)
+	// Output: This is an amazing product: Acme Lazer
+}
+
+func Test_TemplateDelims(t *testing.T) {
+	mux := brush.NewHandleMux()
+	mux.Handle("name", func(scope brush.Scope) (string, error) {
+		return "tim", nil
+	})
+
+	tmpl, err := brush.New("{{ name }} is <% name %>").Delims("<%", "%>").Parse()
+	if assert.NoError(t, err) {
+		result, err := tmpl.Execute(mux)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "{{ name }} is tim", result)
+		}
+	}
+}
+
+func Test_TemplateRecover(t *testing.T) {
+	mux := brush.NewHandleMux()
+	mux.Handle("name", func(scope brush.Scope) (string, error) {
+		return "tim", nil
+	})
+	mux.ErrorPlaceholder(func(node *brush.ErrorNode) string {
+		return "??"
+	})
+
+	tmpl, err := brush.New("{{name}} and {{name?}} and {{name}}").Recover().Parse()
+	if assert.Error(t, err) {
+		result, err := tmpl.Execute(mux)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "tim and ?? and tim", result)
+		}
+	}
+}
+
+func Test_TemplateExecuteTo(t *testing.T) {
+	const doc string = "Some {{bold}}{{word}} {{review}}{{/bold}} text"
+
+	mux := brush.NewHandleMux()
+	mux.Handle("word", func(scope brush.Scope) (string, error) {
+		return "emphasized", nil
+	})
+	mux.HandleStream("review", func(ctx context.Context, w io.Writer, scope brush.Scope) error {
+		_, err := io.WriteString(w, "streamed")
+		return err
+	})
+	mux.HandleBlockStream("bold", func(ctx context.Context, w io.Writer, scope brush.Scope, contents *brush.Template) error {
+		io.WriteString(w, "<b>")
+		if err := contents.ExecuteToContext(ctx, w, mux); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "</b>")
+		return err
+	})
+
+	tmpl, err := brush.New(doc).Parse(mux.BlockHandlers()...)
+	if assert.NoError(t, err) {
+		var buf bytes.Buffer
+		if assert.NoError(t, tmpl.ExecuteTo(&buf, mux)) {
+			assert.Equal(t, "Some <b>emphasized streamed</b> text", buf.String())
+		}
+
+		result, err := tmpl.Execute(mux)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Some <b>emphasized streamed</b> text", result)
+		}
+	}
+}
+
+type userKey struct{}
+
+func Test_TemplateExecuteContext(t *testing.T) {
+	const doc string = "{{preview}}Draft by {{author}}{{/preview}}"
+
+	mux := brush.NewHandleMux()
+	mux.HandleContext("author", func(ctx context.Context, scope brush.Scope) (string, error) {
+		return ctx.Value(userKey{}).(string), nil
+	})
+	mux.HandleBlockContext("preview", func(ctx context.Context, scope brush.Scope, contents *brush.Template) (string, error) {
+		return contents.ExecuteContext(ctx, mux)
+	})
+
+	tmpl, err := brush.New(doc).Parse(mux.BlockHandlers()...)
+	if assert.NoError(t, err) {
+		ctx := context.WithValue(context.Background(), userKey{}, "tim")
+		result, err := tmpl.ExecuteContext(ctx, mux)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Draft by tim", result)
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err = tmpl.ExecuteContext(ctx, mux)
+		assert.Equal(t, context.Canceled, err)
+	}
+}
+
+func Test_TemplateExecuteConcurrent(t *testing.T) {
+	const doc string = "{{product sku=\"a\"}} and {{product sku=\"b\"}}"
+
+	mux := brush.NewHandleMux()
+	mux.HandleContext("product", func(ctx context.Context, scope brush.Scope) (string, error) {
+		return "Camera " + scope.Env["sku"], nil
+	})
+
+	tmpl, err := brush.New(doc).Parse()
+	if assert.NoError(t, err) {
+		result, err := tmpl.ExecuteConcurrent(context.Background(), &brush.ConcurrentExecutor{Workers: 2}, mux)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Camera a and Camera b", result)
+		}
+	}
+}
+
+func Test_TemplatePrefetch(t *testing.T) {
+	const doc string = "{{article.attachments(12345).popup}} and {{article attachment_id=\"678\"}}"
+
+	mux := brush.NewHandleMux()
+	mux.HandleDot("attachments", func(scope brush.Scope) brush.Scope {
+		scope.Env["attachment_id"] = scope.Argument
+		return scope
+	})
+	mux.HandleDot("popup", func(scope brush.Scope) brush.Scope {
+		return scope
+	})
+	var loads int
+	mux.HandleBatch("article", func(scope brush.Scope) []string {
+		return []string{scope.Env["attachment_id"]}
+	}, func(ctx context.Context, keys []string) (map[string]interface{}, error) {
+		loads++
+		return map[string]interface{}{"12345": "Camera", "678": "Lens"}, nil
+	})
+	mux.HandleContext("article", func(ctx context.Context, scope brush.Scope) (string, error) {
+		value, _ := brush.Loaded(ctx, "article", scope.Env["attachment_id"])
+		return fmt.Sprint(value), nil
+	})
+
+	tmpl, err := brush.New(doc).Parse()
+	if assert.NoError(t, err) {
+		ctx, err := tmpl.Prefetch(context.Background(), mux)
+		if assert.NoError(t, err) {
+			result, err := tmpl.ExecuteContext(ctx, mux)
+			if assert.NoError(t, err) {
+				assert.Equal(t, "Camera and Lens", result)
+			}
+			assert.Equal(t, 1, loads)
+		}
+	}
+}
+
+func Test_TemplateValidate(t *testing.T) {
+	const doc string = "{{article.attachments(12345).zoom}} {{bold}}{{author}}{{/bold}}"
+
+	mux := brush.NewHandleMux()
+	mux.Handle("article", func(scope brush.Scope) (string, error) {
+		return "", nil
+	})
+	mux.HandleDot("attachments", func(scope brush.Scope) brush.Scope {
+		return scope
+	})
+	mux.HandleBlock("bold", func(scope brush.Scope, contents *brush.Template) (string, error) {
+		return contents.Execute(mux)
+	})
+
+	tmpl, err := brush.New(doc).Parse(mux.BlockHandlers()...)
+	if assert.NoError(t, err) {
+		err = tmpl.Validate(mux)
+		if errs, ok := err.(brush.ErrorList); assert.True(t, ok) && assert.Len(t, errs, 2) {
+			assert.EqualError(t, errs[0], "brush:1:1: Exec error - Dot handler not defined for `zoom` in article tag")
+			assert.EqualError(t, errs[1], "brush:1:45: Exec error - Handler not defined for tag: author")
+		}
+	}
+}
+
+func Test_TemplateValidateHandlerKinds(t *testing.T) {
+	const doc string = "{{ctxp.nme}} {{safe.nme}} {{stream.nme}} {{other.nme}} {{ctxp.name}}"
+
+	mux := brush.NewHandleMux()
+	mux.HandleDot("name", func(scope brush.Scope) brush.Scope {
+		return scope
+	})
+	mux.HandleContext("ctxp", func(ctx context.Context, scope brush.Scope) (string, error) {
+		return "", nil
+	})
+	// the context handler still takes precedence
+	mux.Handle("ctxp", func(scope brush.Scope) (string, error) {
+		return "", nil
+	})
+	mux.HandleSafe("safe", func(scope brush.Scope) (brush.SafeHTML, error) {
+		return "", nil
+	})
+	mux.HandleStream("stream", func(ctx context.Context, w io.Writer, scope brush.Scope) error {
+		return nil
+	})
+	mux.DefaultHandler(func(scope brush.Scope) (string, error) {
+		return "", nil
+	})
+
+	tmpl, err := brush.New(doc).Parse()
+	if assert.NoError(t, err) {
+		err = tmpl.Validate(mux)
+		if errs, ok := err.(brush.ErrorList); assert.True(t, ok) && assert.Len(t, errs, 4) {
+			assert.EqualError(t, errs[0], "brush:1:1: Exec error - Dot handler not defined for `nme` in ctxp tag")
+			assert.EqualError(t, errs[1], "brush:1:14: Exec error - Dot handler not defined for `nme` in safe tag")
+			assert.EqualError(t, errs[2], "brush:1:27: Exec error - Dot handler not defined for `nme` in stream tag")
+			assert.EqualError(t, errs[3], "brush:1:42: Exec error - Dot handler not defined for `nme` in other tag")
+		}
+		_, err = tmpl.Execute(mux)
+		assert.EqualError(t, err, "brush:1:1: Exec error - Dot handler not defined for `nme` in ctxp tag")
+	}
+}
+
+func Test_TemplateSchemaDefaults(t *testing.T) {
+	const doc string = `{{article.attachments(12345)}} {{article.attachments(678) mode="zoom"}}`
+
+	mux := brush.NewHandleMux()
+	mux.DefineSchema("article", brush.TagSchema{
+		DotCommands: []string{"attachments"},
+		Attributes: map[string]brush.ValueSchema{
+			"mode": {Enum: []string{"inline", "popup"}, Default: "inline"},
+		},
+	})
+	mux.HandleDot("attachments", func(scope brush.Scope) brush.Scope {
+		scope.Env["attachment_id"] = scope.Argument
+		return scope
+	})
+	mux.Handle("article", func(scope brush.Scope) (string, error) {
+		return scope.Env["attachment_id"] + ":" + scope.Env["mode"], nil
+	})
+
+	tmpl, err := brush.New(doc).Parse()
+	if assert.NoError(t, err) {
+		err = tmpl.Validate(mux)
+		if errs, ok := err.(brush.ErrorList); assert.True(t, ok) && assert.Len(t, errs, 1) {
+			assert.EqualError(t, errs[0], "brush:1:59: Schema error - Attribute mode=\"zoom\" to article tag: expected one of inline, popup")
+		}
+
+		result, err := tmpl.Execute(mux)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "12345:inline 678:zoom", result)
+		}
+	}
+}
+
+func Test_Catalog(t *testing.T) {
+	mux := brush.NewHandleMux()
+	mux.Handle("article", func(scope brush.Scope) (string, error) {
+		return "", nil
+	})
+	mux.DefineSchema("article", brush.TagSchema{Description: "An article"})
+	mux.HandleDot("attachments", func(scope brush.Scope) brush.Scope {
+		return scope
+	})
+	mux.HandleBlock("bold", func(scope brush.Scope, contents *brush.Template) (string, error) {
+		return contents.Execute(mux)
+	})
+
+	catalog := mux.Catalog()
+	assert.Equal(t, []brush.TagInfo{
+		{Name: "article", Description: "An article"},
+		{Name: "bold", Block: true},
+	}, catalog.Tags)
+	assert.Equal(t, []string{"attachments"}, catalog.DotCommands)
+}
+
+func Test_TemplateEscaping(t *testing.T) {
+	const doc string = `{{product}} {{badge}}`
+
+	mux := brush.NewHandleMux()
+	mux.Handle("product", func(scope brush.Scope) (string, error) {
+		return `Lens "50mm" <f/1.8>`, nil
+	})
+	mux.HandleSafe("badge", func(scope brush.Scope) (brush.SafeHTML, error) {
+		return "<b>New</b>", nil
+	})
+
+	tmpl, err := brush.New(doc).Parse()
+	if assert.NoError(t, err) {
+		result, err := tmpl.Execute(mux)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Lens &#34;50mm&#34; &lt;f/1.8&gt; <b>New</b>", result)
+		}
+
+		mux.Escaping(brush.EscapeNone)
+		result, err = tmpl.Execute(mux)
+		if assert.NoError(t, err) {
+			assert.Equal(t, `Lens "50mm" <f/1.8> <b>New</b>`, result)
+		}
+	}
+}
+
+func Test_TemplateContextualEscaping(t *testing.T) {
+	const doc string = `<a href="/products?sku={{sku}}" title="{{product}}">{{product}}</a>`
+
+	mux := brush.NewHandleMux()
+	mux.Handle("sku", func(scope brush.Scope) (string, error) {
+		return "A&B 1", nil
+	})
+	mux.Handle("product", func(scope brush.Scope) (string, error) {
+		return `Lens <50mm>`, nil
+	})
+
+	tmpl, err := brush.New(doc).Parse()
+	if assert.NoError(t, err) {
+		result, err := tmpl.Execute(mux)
+		if assert.NoError(t, err) {
+			assert.Equal(t, `<a href="/products?sku=A%26B+1" title="Lens &lt;50mm&gt;">Lens &lt;50mm&gt;</a>`, result)
+		}
+	}
+}
+
+func Test_TemplatePrint(t *testing.T) {
+	tmpl, err := brush.New("<< product.name size='big' , zoom=true >> <<callout>>{{text}}<</callout>>").Delims("<<", ">>").Parse("callout")
+	if assert.NoError(t, err) {
+		var buf bytes.Buffer
+		if assert.NoError(t, tmpl.Print(&buf)) {
+			assert.Equal(t, `<<product.name size="big" zoom="true">> <<callout>>{{text}}<</callout>>`, buf.String())
+		}
+	}
+}
+
+func Test_TemplateLossless(t *testing.T) {
+	const doc string = "{{ product.name  size='big' }} {{callout -}}\n  {{ price }}\n{{/callout}}"
+
+	tmpl, err := brush.New(doc).Lossless().Parse("callout")
+	if !assert.NoError(t, err) {
+		return
+	}
+	var buf bytes.Buffer
+	if assert.NoError(t, tmpl.Print(&buf)) {
+		assert.Equal(t, doc, buf.String())
+	}
+
+	root := tmpl.Root().(*brush.DocumentNode)
+	root.NodeList[1].(*brush.BraaiTagNode).Text = "item"
+	buf.Reset()
+	if assert.NoError(t, tmpl.Print(&buf)) {
+		assert.Equal(t, "{{ item.name size=\"big\" }} {{callout -}}\n  {{ price }}\n{{/callout}}", buf.String())
+	}
+}
+
+func Test_TemplateRewrite(t *testing.T) {
+	tmpl, err := brush.New(`<a title="{{brightcove(123)}}">{{brightcove}}</a>`).Lossless().Parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = tmpl.Rewrite(func(node brush.Node) (brush.Node, brush.Action) {
+		if tag, ok := node.(*brush.BraaiTagNode); ok && tag.Text == "brightcove" && len(tag.Arguments) > 0 {
+			return &brush.BraaiTagNode{Text: "video", Attributes: map[string]string{"id": tag.Arguments[0]}}, brush.Continue
+		}
+		return node, brush.Continue
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var buf bytes.Buffer
+	if assert.NoError(t, tmpl.Print(&buf)) {
+		assert.Equal(t, `<a title="{{video id="123"}}">{{brightcove}}</a>`, buf.String())
+	}
+	mux := brush.NewHandleMux()
+	mux.Handle("video", func(scope brush.Scope) (string, error) {
+		return `<video id="` + scope.Env["id"] + `">`, nil
+	})
+	mux.Handle("brightcove", func(scope brush.Scope) (string, error) {
+		return "", nil
+	})
+	result, err := tmpl.Execute(mux)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `<a title="&lt;video id=&#34;123&#34;&gt;"></a>`, result)
+	}
+}
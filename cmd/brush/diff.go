@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines surrounding each change
+const diffContext = 3
+
+// A lineEdit is a single line of a diff, along with the index of the line in
+// each document at which it appears
+type lineEdit struct {
+	kind byte // ' ' for unchanged lines, '-' for removed lines, '+' for added lines
+	line string
+	a, b int
+}
+
+// unifiedDiff returns the differences between the documents a and b, both
+// called name, in the unified format produced by diff -u. It returns an empty
+// string if the documents are identical.
+func unifiedDiff(name, a, b string) string {
+	if a == b {
+		return ""
+	}
+	edits := diffLines(splitLines(a), splitLines(b))
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- a/%s\n+++ b/%s\n", name, name)
+	for i := 0; i < len(edits); {
+		if edits[i].kind == ' ' {
+			i++
+			continue
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for end < len(edits) {
+			if edits[end].kind != ' ' {
+				end++
+				continue
+			}
+			unchanged := end
+			for unchanged < len(edits) && edits[unchanged].kind == ' ' {
+				unchanged++
+			}
+			if unchanged == len(edits) || unchanged-end > 2*diffContext {
+				end += diffContext
+				if end > len(edits) {
+					end = len(edits)
+				}
+				break
+			}
+			end = unchanged
+		}
+		writeHunk(&out, edits[start:end])
+		i = end
+	}
+	return out.String()
+}
+
+// writeHunk writes the header and lines of a single hunk
+func writeHunk(out *strings.Builder, hunk []lineEdit) {
+	var aLines, bLines int
+	for _, edit := range hunk {
+		if edit.kind != '+' {
+			aLines++
+		}
+		if edit.kind != '-' {
+			bLines++
+		}
+	}
+	// an empty range is numbered by the line preceding it
+	aStart, bStart := hunk[0].a+1, hunk[0].b+1
+	if aLines == 0 {
+		aStart--
+	}
+	if bLines == 0 {
+		bStart--
+	}
+	fmt.Fprintf(out, "@@ -%d,%d +%d,%d @@\n", aStart, aLines, bStart, bLines)
+	for _, edit := range hunk {
+		out.WriteByte(edit.kind)
+		out.WriteString(edit.line)
+		if !strings.HasSuffix(edit.line, "\n") {
+			out.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// splitLines splits text into lines, each retaining its newline
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the shortest sequence of edits transforming a into b,
+// found using the longest common subsequence of their lines. Migrations
+// usually change a few lines of each document, so the lines shared by the
+// beginning and end of both documents are matched directly, leaving only the
+// lines between them for the quadratic table.
+func diffLines(a, b []string) []lineEdit {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	edits := make([]lineEdit, 0, len(a)+len(b)-prefix-suffix)
+	for i := 0; i < prefix; i++ {
+		edits = append(edits, lineEdit{' ', a[i], i, i})
+	}
+	edits = append(edits, diffMiddle(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix], prefix)...)
+	for i := len(a) - suffix; i < len(a); i++ {
+		edits = append(edits, lineEdit{' ', a[i], i, i - len(a) + len(b)})
+	}
+	return edits
+}
+
+// diffMiddle is like diffLines, but numbers the lines of a and b from offset,
+// since they follow the lines shared by the beginning of both documents
+func diffMiddle(a, b []string, offset int) []lineEdit {
+	// common[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:]
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	var edits []lineEdit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, lineEdit{' ', a[i], offset + i, offset + j})
+			i, j = i+1, j+1
+		case j == len(b) || i < len(a) && common[i+1][j] >= common[i][j+1]:
+			edits = append(edits, lineEdit{'-', a[i], offset + i, offset + j})
+			i++
+		default:
+			edits = append(edits, lineEdit{'+', b[j], offset + i, offset + j})
+			j++
+		}
+	}
+	return edits
+}
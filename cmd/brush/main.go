@@ -0,0 +1,38 @@
+// Brush is a tool for managing Braai documents.
+//
+// Usage:
+//   brush <command> [arguments]
+//
+// The commands are:
+//   migrate   apply a file of migration rules to stored documents
+//
+// Run brush <command> -h for the arguments of a command.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: brush <command> [arguments]\n\n")
+	fmt.Fprintf(os.Stderr, "The commands are:\n")
+	fmt.Fprintf(os.Stderr, "\tmigrate   apply a file of migration rules to stored documents\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "migrate":
+		os.Exit(migrateCommand(os.Args[2:]))
+	case "-h", "-help", "--help", "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "brush: unknown command %s\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/timraymond/brush/parse"
+)
+
+const migrateUsage = `usage: brush migrate -rules file [flags] path ...
+
+Migrate applies the rules in the rules file to the tags of every document
+found at the given paths, printing a diff of each changed document followed
+by a report of the documents which could not be parsed. A path may be a
+single document, a dump of documents with the extension .jsonl, holding one
+JSON object per line, or a directory, which is searched recursively for
+documents with the extension given by -ext and for dumps. Documents are parsed losslessly,
+so only the migrated tags change.
+
+The flags are:
+`
+
+// A migration holds the settings of the migrate command
+type migration struct {
+	rules       []Rule
+	blocks      []string
+	left, right string
+	ext         string
+	idField     string
+	bodyField   string
+	write       bool
+	out         io.Writer // receives the diff
+}
+
+// A report summarizes the outcome of a migration
+type report struct {
+	documents int
+	changed   int
+	failed    []error
+}
+
+// migrateCommand runs the migrate command with args, returning the exit
+// code: 1 if any document could not be migrated, or 2 for invalid usage
+func migrateCommand(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, migrateUsage)
+		flags.PrintDefaults()
+	}
+	rulesPath := flags.String("rules", "", "the JSON file of migration rules")
+	blocks := flags.String("blocks", "", "the identifiers of block tags, separated by commas")
+	delims := flags.String("delims", "", "the left and right delimiters, separated by a space")
+	ext := flags.String("ext", ".braai", "the extension of documents within directories")
+	idField := flags.String("id", "id", "the field identifying each document of a .jsonl dump")
+	bodyField := flags.String("body", "body", "the field holding each document of a .jsonl dump")
+	write := flags.Bool("w", false, "write migrated documents back to their files")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *rulesPath == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	m := &migration{ext: *ext, idField: *idField, bodyField: *bodyField, write: *write, out: os.Stdout}
+	if *delims != "" {
+		parts := strings.Fields(*delims)
+		if len(parts) != 2 {
+			fmt.Fprintf(os.Stderr, "brush: -delims must be two delimiters separated by a space\n")
+			return 2
+		}
+		m.left, m.right = parts[0], parts[1]
+	}
+	if *blocks != "" {
+		m.blocks = strings.Split(*blocks, ",")
+	}
+	rules, err := loadRules(*rulesPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "brush: %s\n", err)
+		return 2
+	}
+	m.rules = rules
+
+	r := &report{}
+	for _, path := range flags.Args() {
+		if err := m.path(path, r); err != nil {
+			r.failed = append(r.failed, err)
+		}
+	}
+	r.write(os.Stderr)
+	if len(r.failed) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// write prints the report to w
+func (r *report) write(w io.Writer) {
+	fmt.Fprintf(w, "Migrated %d of %d documents\n", r.changed, r.documents)
+	if len(r.failed) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Could not migrate %d documents:\n", len(r.failed))
+	for _, err := range r.failed {
+		fmt.Fprintf(w, "\t%s\n", err)
+	}
+}
+
+// path migrates the documents found at path
+func (m *migration) path(path string, r *report) error {
+	info, err := os.Stat(path)
+	switch {
+	case err != nil:
+		return err
+	case info.IsDir():
+		return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				r.failed = append(r.failed, err)
+				return nil
+			}
+			switch {
+			case info.IsDir():
+			case filepath.Ext(path) == ".jsonl":
+				err = m.dump(path, info, r)
+			case filepath.Ext(path) == m.ext:
+				err = m.file(path, info, r)
+			}
+			if err != nil {
+				r.failed = append(r.failed, err)
+			}
+			return nil
+		})
+	case filepath.Ext(path) == ".jsonl":
+		return m.dump(path, info, r)
+	default:
+		return m.file(path, info, r)
+	}
+}
+
+// file migrates the document stored in the file at path
+func (m *migration) file(path string, info os.FileInfo, r *report) error {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	res, changed, err := m.document(path, string(src), r)
+	if err != nil || !changed || !m.write {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(res), info.Mode().Perm())
+}
+
+// dump migrates each document of the .jsonl dump at path. Lines which do not
+// hold a document are left alone.
+func (m *migration) dump(path string, info os.FileInfo, r *report) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var out bytes.Buffer
+	var rewritten bool
+	reader := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		text, err := reader.ReadString('\n')
+		if text == "" && err != nil {
+			if err != io.EOF {
+				return err
+			}
+			break
+		}
+		res, changed, lineErr := m.record(path, line, text, r)
+		if lineErr != nil {
+			r.failed = append(r.failed, lineErr)
+		}
+		out.WriteString(res)
+		rewritten = rewritten || changed
+	}
+	if !rewritten || !m.write {
+		return nil
+	}
+	return ioutil.WriteFile(path, out.Bytes(), info.Mode().Perm())
+}
+
+// record migrates the document held by a single line of a .jsonl dump,
+// returning the line to write back
+func (m *migration) record(path string, line int, text string, r *report) (string, bool, error) {
+	if strings.TrimSpace(text) == "" {
+		return text, false, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(text), &fields); err != nil {
+		return text, false, fmt.Errorf("%s:%d: %s", path, line, err)
+	}
+	var body string
+	if err := json.Unmarshal(fields[m.bodyField], &body); err != nil {
+		return text, false, fmt.Errorf("%s:%d: no %s field holding a document", path, line, m.bodyField)
+	}
+	id := path + ":" + strconv.Itoa(line)
+	var value interface{}
+	if json.Unmarshal(fields[m.idField], &value) == nil && value != nil {
+		id = fmt.Sprint(value)
+	}
+
+	res, changed, err := m.document(id, body, r)
+	if err != nil || !changed {
+		return text, false, err
+	}
+	encoded, err := marshal(res)
+	if err != nil {
+		return text, false, err
+	}
+	start, end, ok := valueSpan(text, m.bodyField)
+	if !ok {
+		return text, false, fmt.Errorf("%s:%d: no %s field holding a document", path, line, m.bodyField)
+	}
+	return text[:start] + string(encoded) + text[end:], true, nil
+}
+
+// valueSpan returns the offsets within text of the value of field, a member
+// of the JSON object held by text, so that the value can be replaced without
+// disturbing the rest of the object. As with json.Unmarshal, the last of any
+// duplicate members counts.
+func valueSpan(text, field string) (start, end int, ok bool) {
+	dec := json.NewDecoder(strings.NewReader(text))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return 0, 0, false
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return 0, 0, false
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return 0, 0, false
+		}
+		if key == field {
+			end = int(dec.InputOffset())
+			start, ok = end-len(value), true
+		}
+	}
+	return start, end, ok
+}
+
+// marshal encodes v as JSON without escaping HTML, which is common in
+// documents
+func marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// document migrates src, which is identified by name, printing a diff if it
+// changed
+func (m *migration) document(name, src string, r *report) (string, bool, error) {
+	r.documents++
+	root, err := parse.New(name, src, m.blocks).Delims(m.left, m.right).Lossless().Parse()
+	if err != nil {
+		return src, false, err
+	}
+	root = applyRules(m.rules, root)
+
+	var buf bytes.Buffer
+	printer := &parse.Printer{LeftDelim: m.left, RightDelim: m.right}
+	if err := printer.Print(&buf, root); err != nil {
+		return src, false, err
+	}
+	res := buf.String()
+	if res == src {
+		return src, false, nil
+	}
+	r.changed++
+	fmt.Fprint(m.out, unifiedDiff(name, src, res))
+	return res, true, nil
+}
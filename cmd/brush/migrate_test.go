@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testRules = []Rule{
+	{Action: renameTag, Tag: "brightcove", To: "video"},
+	{Action: argumentToAttribute, Tag: "video", Argument: 1, Attribute: "id"},
+	{Action: renameAttribute, Tag: "gallery", Attribute: "size", To: "layout"},
+	{Action: dropDotCommand, Tag: "product", DotCommand: "legacy"},
+	{Action: renameTag, Tag: "callout", To: "aside"},
+}
+
+func TestMigrateDocument(t *testing.T) {
+	tests := []struct {
+		name, input, output string
+	}{
+		{"rename and move argument", "Watch {{ brightcove(123) autoplay='true' }}!", `Watch {{ video autoplay="true" id="123" }}!`},
+		{"quoted argument", "{{brightcove 'abc', 'x'}}", `{{video "x" id="abc"}}`},
+		{"rename attribute", "{{gallery size='big'}} {{ gallery  layout='grid' size='big' }}", `{{gallery layout="big"}} {{ gallery  layout='grid' size='big' }}`},
+		{"drop dot command", "{{product(1).legacy.name}}", "{{product(1).name}}"},
+		{"block", "{{callout -}}\n  {{ product.legacy }}\n{{-/callout}} {{callout}} {{/callout}}", "{{aside -}}\n  {{ product }}\n{{-/aside}} {{aside}} {{/aside}}"},
+		{"untouched", "{{ other 'x' }}\n", "{{ other 'x' }}\n"},
+	}
+	m := &migration{rules: testRules, blocks: []string{"callout", "aside"}, out: &bytes.Buffer{}}
+	for _, test := range tests {
+		r := &report{}
+		res, changed, err := m.document(test.name, test.input, r)
+		if err != nil {
+			t.Errorf("%s:\n\tUnexpected error: %s", test.name, err)
+			continue
+		}
+		if res != test.output {
+			t.Errorf("%s:\n\texpected %q\n\tgot      %q", test.name, test.output, res)
+		}
+		if expected := test.input != test.output; changed != expected || r.documents != 1 || (r.changed == 1) != expected {
+			t.Errorf("%s:\n\tunexpected changed %v, report %+v", test.name, changed, r)
+		}
+	}
+}
+
+func TestMigrateRecord(t *testing.T) {
+	var diff bytes.Buffer
+	m := &migration{rules: testRules, idField: "id", bodyField: "body", out: &diff}
+	r := &report{}
+
+	line, changed, err := m.record("dump.jsonl", 1, `{"id": 7, "body": "<p>{{brightcove(1)}}</p>", "title": "A"}`+"\n", r)
+	if err != nil || !changed {
+		t.Fatalf("expected the record to change, got %v, %v", changed, err)
+	}
+	if expected := `{"id": 7, "body": "<p>{{video id=\"1\"}}</p>", "title": "A"}` + "\n"; line != expected {
+		t.Errorf("expected %q\n\tgot      %q", expected, line)
+	}
+	line, _, err = m.record("dump.jsonl", 4, `{ "meta":{"body":"x"},"body" : "{{brightcove(2)}}" }`, r)
+	if expected := `{ "meta":{"body":"x"},"body" : "{{video id=\"2\"}}" }`; err != nil || line != expected {
+		t.Errorf("expected %q\n\tgot      %q (%v)", expected, line, err)
+	}
+	if expected := "--- a/7\n+++ b/7\n"; !strings.HasPrefix(diff.String(), expected) {
+		t.Errorf("expected the diff to name the record, got %q", diff.String())
+	}
+
+	_, _, err = m.record("dump.jsonl", 2, `{"id": 8, "body": "{{brightcove?}}"}`, r)
+	if err == nil || !strings.HasPrefix(err.Error(), "8:1:13: Lexical Error") {
+		t.Errorf("expected a lexical error for record 8, got %v", err)
+	}
+	_, _, err = m.record("dump.jsonl", 3, `{"id": 9}`, r)
+	if err == nil || err.Error() != "dump.jsonl:3: no body field holding a document" {
+		t.Errorf("expected a missing body error, got %v", err)
+	}
+	if r.documents != 3 || r.changed != 2 {
+		t.Errorf("unexpected report %+v", r)
+	}
+}
+
+func TestMigrateDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "brush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"a.braai":          "{{brightcove(1)}}",
+		"dumps/b.jsonl":    `{"id": 2, "body": "{{brightcove(2)}}"}` + "\n",
+		"dumps/notes.txt":  "{{brightcove(3)}}",
+		"dumps/c.jsonl.gz": "",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := &migration{rules: testRules, ext: ".braai", idField: "id", bodyField: "body", write: true, out: &bytes.Buffer{}}
+	r := &report{}
+	if err := m.path(dir, r); err != nil || len(r.failed) > 0 {
+		t.Fatalf("Unexpected errors: %v %v", err, r.failed)
+	}
+	if r.documents != 2 || r.changed != 2 {
+		t.Errorf("unexpected report %+v", r)
+	}
+	expected := map[string]string{
+		"a.braai":         `{{video id="1"}}`,
+		"dumps/b.jsonl":   `{"id": 2, "body": "{{video id=\"2\"}}"}` + "\n",
+		"dumps/notes.txt": "{{brightcove(3)}}",
+	}
+	for name, content := range expected {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(data) != content {
+			t.Errorf("%s: expected %q, got %q (%v)", name, content, data, err)
+		}
+	}
+}
+
+func TestRuleCheck(t *testing.T) {
+	tests := []struct {
+		rule Rule
+		err  string
+	}{
+		{Rule{Action: renameTag, Tag: "a", To: "b"}, ""},
+		{Rule{Action: renameTag, To: "b"}, "missing tag"},
+		{Rule{Action: renameTag, Tag: "a"}, "rename_tag requires to"},
+		{Rule{Action: argumentToAttribute, Tag: "a", Attribute: "id"}, "argument_to_attribute requires argument"},
+		{Rule{Action: "explode", Tag: "a"}, `unknown action "explode"`},
+	}
+	for _, test := range tests {
+		err := test.rule.check()
+		if (err == nil) != (test.err == "") || err != nil && err.Error() != test.err {
+			t.Errorf("%+v:\n\texpected %q, got %v", test.rule, test.err, err)
+		}
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\n"
+	b := "one\n2\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\neleven"
+	expected := `--- a/doc
++++ b/doc
+@@ -1,5 +1,5 @@
+ one
+-two
++2
+ three
+ four
+ five
+@@ -8,3 +8,4 @@
+ eight
+ nine
+ ten
++eleven
+\ No newline at end of file
+`
+	if diff := unifiedDiff("doc", a, b); diff != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, diff)
+	}
+	if diff := unifiedDiff("doc", a, a); diff != "" {
+		t.Errorf("expected no diff for identical documents, got %q", diff)
+	}
+	if diff := unifiedDiff("doc", "", "a\n"); diff != "--- a/doc\n+++ b/doc\n@@ -0,0 +1,1 @@\n+a\n" {
+		t.Errorf("unexpected diff from an empty document: %q", diff)
+	}
+}
+
+func TestUnifiedDiffLongDocument(t *testing.T) {
+	// the full table of a quadratic diff would hold 400 million entries
+	lines := make([]string, 20000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d\n", i+1)
+	}
+	a := strings.Join(lines, "")
+	lines[9999] = "changed\n"
+	b := strings.Join(lines, "")
+
+	expected := `--- a/doc
++++ b/doc
+@@ -9997,7 +9997,7 @@
+ line 9997
+ line 9998
+ line 9999
+-line 10000
++changed
+ line 10001
+ line 10002
+ line 10003
+`
+	if diff := unifiedDiff("doc", a, b); diff != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, diff)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/timraymond/brush/parse"
+)
+
+// The actions a Rule may perform
+const (
+	renameTag           = "rename_tag"            // renames the tag to To
+	renameAttribute     = "rename_attribute"      // renames Attribute to To
+	argumentToAttribute = "argument_to_attribute" // moves positional Argument into Attribute
+	dropDotCommand      = "drop_dot_command"      // removes the dot command named DotCommand
+)
+
+// A Rule describes one change to every tag named Tag. Rules are applied in
+// the order they appear in the rules file, so a rule following a rename_tag
+// rule refers to the tag by its new name. For example:
+//   [
+//     {"action": "rename_tag", "tag": "brightcove", "to": "video"},
+//     {"action": "argument_to_attribute", "tag": "video", "argument": 1, "attribute": "id"},
+//     {"action": "rename_attribute", "tag": "gallery", "attribute": "size", "to": "layout"},
+//     {"action": "drop_dot_command", "tag": "product", "dot_command": "legacy"}
+//   ]
+// Arguments are numbered from 1. Renaming applies to block tags as well, while
+// the other actions apply to regular tags only. A rule which would replace an
+// attribute which is already present leaves the tag alone.
+type Rule struct {
+	Action     string `json:"action"`
+	Tag        string `json:"tag"`
+	To         string `json:"to,omitempty"`
+	Attribute  string `json:"attribute,omitempty"`
+	Argument   int    `json:"argument,omitempty"`
+	DotCommand string `json:"dot_command,omitempty"`
+}
+
+// loadRules reads and checks the rules file at path
+func loadRules(path string) ([]Rule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	for i, rule := range rules {
+		if err := rule.check(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %s", path, i+1, err)
+		}
+	}
+	return rules, nil
+}
+
+// check ensures that the Rule has every field its action requires
+func (r Rule) check() error {
+	if r.Tag == "" {
+		return fmt.Errorf("missing tag")
+	}
+	var missing string
+	switch r.Action {
+	case renameTag:
+		if r.To == "" {
+			missing = "to"
+		}
+	case renameAttribute:
+		if r.Attribute == "" {
+			missing = "attribute"
+		} else if r.To == "" {
+			missing = "to"
+		}
+	case argumentToAttribute:
+		if r.Argument < 1 {
+			missing = "argument"
+		} else if r.Attribute == "" {
+			missing = "attribute"
+		}
+	case dropDotCommand:
+		if r.DotCommand == "" {
+			missing = "dot_command"
+		}
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	if missing != "" {
+		return fmt.Errorf("%s requires %s", r.Action, missing)
+	}
+	return nil
+}
+
+// applyRules applies every rule to the tags within root, modifying them in
+// place
+func applyRules(rules []Rule, root parse.Node) parse.Node {
+	return parse.Rewrite(root, func(node parse.Node) (parse.Node, parse.Action) {
+		for _, rule := range rules {
+			switch n := node.(type) {
+			case *parse.BlockTagNode:
+				if rule.Action == renameTag && n.Name == rule.Tag {
+					n.Name = rule.To
+				}
+			case *parse.BraaiTagNode:
+				if n.Text == rule.Tag {
+					rule.apply(n)
+				}
+			}
+		}
+		return node, parse.Continue
+	})
+}
+
+// apply performs the Rule's action on tag
+func (r Rule) apply(tag *parse.BraaiTagNode) {
+	switch r.Action {
+	case renameTag:
+		tag.Text = r.To
+	case renameAttribute:
+		value, ok := tag.Attributes[r.Attribute]
+		if _, exists := tag.Attributes[r.To]; !ok || exists {
+			return
+		}
+		delete(tag.Attributes, r.Attribute)
+		tag.Attributes[r.To] = value
+	case argumentToAttribute:
+		i := r.Argument - 1
+		if _, exists := tag.Attributes[r.Attribute]; i >= len(tag.Arguments) || exists {
+			return
+		}
+		if tag.Attributes == nil {
+			tag.Attributes = make(map[string]string)
+		}
+		tag.Attributes[r.Attribute] = tag.Arguments[i]
+		tag.Arguments = append(tag.Arguments[:i:i], tag.Arguments[i+1:]...)
+		if i < len(tag.ArgumentNodes) {
+			tag.ArgumentNodes = append(tag.ArgumentNodes[:i:i], tag.ArgumentNodes[i+1:]...)
+		}
+		if i == 0 {
+			tag.CommandArgument = false
+		}
+	case dropDotCommand:
+		var kept []parse.DotCommandNode
+		for _, cmd := range tag.DotCommands {
+			if cmd.Text != r.DotCommand {
+				kept = append(kept, cmd)
+			}
+		}
+		tag.DotCommands = kept
+	}
+}
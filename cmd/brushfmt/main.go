@@ -0,0 +1,151 @@
+// Brushfmt reformats Braai documents into canonical form, as produced by
+// parse.Print.
+//
+// Usage:
+//   brushfmt [flags] [path ...]
+//
+// Without paths, the document is read from standard input and written to
+// standard output. Directories are searched recursively for files with the
+// extension given by -ext. The flags are:
+//   -blocks callout,float_right
+//     	the identifiers of block tags, separated by commas
+//   -delims "[[ ]]"
+//     	the left and right delimiters, separated by a space
+//   -ext .braai
+//     	the extension of documents within directories
+//   -l
+//     	list the files whose formatting differs from brushfmt's
+//   -w
+//     	write the result to the file rather than to standard output
+//
+// Whitespace removed by trim markers is removed from the document itself.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/timraymond/brush/parse"
+)
+
+var (
+	blocks = flag.String("blocks", "", "the identifiers of block tags, separated by commas")
+	delims = flag.String("delims", "", "the left and right delimiters, separated by a space")
+	ext    = flag.String("ext", ".braai", "the extension of documents within directories")
+	list   = flag.Bool("l", false, "list the files whose formatting differs from brushfmt's")
+	write  = flag.Bool("w", false, "write the result to the file rather than to standard output")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: brushfmt [flags] [path ...]\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	var left, right string
+	if *delims != "" {
+		parts := strings.Fields(*delims)
+		if len(parts) != 2 {
+			fmt.Fprintf(os.Stderr, "brushfmt: -delims must be two delimiters separated by a space\n")
+			os.Exit(2)
+		}
+		left, right = parts[0], parts[1]
+	}
+	f := &formatter{left: left, right: right}
+	if *blocks != "" {
+		f.blocks = strings.Split(*blocks, ",")
+	}
+
+	if flag.NArg() == 0 {
+		if *write {
+			fmt.Fprintf(os.Stderr, "brushfmt: cannot use -w with standard input\n")
+			os.Exit(2)
+		}
+		src, err := ioutil.ReadAll(os.Stdin)
+		if err == nil {
+			err = f.file("<standard input>", src, 0)
+		}
+		f.report(err)
+	}
+	for _, path := range flag.Args() {
+		info, err := os.Stat(path)
+		switch {
+		case err != nil:
+			f.report(err)
+		case info.IsDir():
+			f.report(filepath.Walk(path, f.walk))
+		default:
+			f.report(f.path(path, info))
+		}
+	}
+	os.Exit(f.exitCode)
+}
+
+// A formatter formats documents according to the flags
+type formatter struct {
+	blocks      []string
+	left, right string
+	exitCode    int
+}
+
+func (f *formatter) report(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		f.exitCode = 2
+	}
+}
+
+// walk formats the documents within a directory
+func (f *formatter) walk(path string, info os.FileInfo, err error) error {
+	if err == nil && !info.IsDir() && filepath.Ext(path) == *ext {
+		err = f.path(path, info)
+	}
+	f.report(err)
+	return nil
+}
+
+func (f *formatter) path(path string, info os.FileInfo) error {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return f.file(path, src, info.Mode().Perm())
+}
+
+// file formats the document src read from filename, writing the result
+// according to the flags
+func (f *formatter) file(filename string, src []byte, perm os.FileMode) error {
+	root, err := parse.New(filename, string(src), f.blocks).Delims(f.left, f.right).Parse()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	printer := &parse.Printer{LeftDelim: f.left, RightDelim: f.right}
+	if err := printer.Print(&buf, root); err != nil {
+		return err
+	}
+	res := buf.Bytes()
+
+	if !*list && !*write {
+		_, err = os.Stdout.Write(res)
+		return err
+	}
+	if bytes.Equal(src, res) {
+		return nil
+	}
+	if *list {
+		fmt.Println(filename)
+	}
+	if *write {
+		return ioutil.WriteFile(filename, res, perm)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package brush
+
+import (
+	"context"
+	"io"
+
+	"github.com/timraymond/brush/parse"
+)
+
+// A Scope is the environment available to a handler while it renders a single
+// Braai tag. Attributes seed the Env of a tag, which is then transformed by
+// its dot commands from right to left. See parse.Scope for details.
+type Scope = parse.Scope
+
+// SafeHTML is markup from a trusted source, which is never escaped
+type SafeHTML = parse.SafeHTML
+
+// An Escaping is a policy for escaping the output of handlers. See
+// parse.Escaping for details.
+type Escaping = parse.Escaping
+
+// The Escaping policies which may be passed to HandleMux.Escaping
+const (
+	EscapeNone       = parse.EscapeNone       // output is used verbatim
+	EscapeHTML       = parse.EscapeHTML       // output is escaped for HTML text
+	EscapeAttribute  = parse.EscapeAttribute  // output is escaped for HTML attribute values
+	EscapeURL        = parse.EscapeURL        // output is escaped for URL query components
+	EscapeFullURL    = parse.EscapeFullURL    // output is a complete URL within an HTML attribute
+	EscapeContextual = parse.EscapeContextual // output is escaped to suit the HTML surrounding each tag
+)
+
+// A TagSchema describes the dot commands, arguments and attributes accepted by
+// a Braai tag. See parse.TagSchema for details.
+type TagSchema = parse.TagSchema
+
+// A ValueSchema describes a single argument or attribute of a TagSchema
+type ValueSchema = parse.ValueSchema
+
+// A ValueType is the type of a value described by a ValueSchema
+type ValueType = parse.ValueType
+
+// The ValueTypes of a ValueSchema
+const (
+	StringValue = parse.StringValue // any text
+	BoolValue   = parse.BoolValue   // true or false
+	IntValue    = parse.IntValue    // an integer
+	FloatValue  = parse.FloatValue  // any number
+)
+
+// A Catalog lists every tag registered with a HandleMux, for use by editors
+type Catalog = parse.Catalog
+
+// A TagInfo describes a single tag within a Catalog
+type TagInfo = parse.TagInfo
+
+// A CommandHandler is responsible for producing the final output of a Braai
+// tag from its Scope, regardless of previous alterations to the environment
+type CommandHandler func(Scope) (string, error)
+
+// A SafeCommandHandler is a CommandHandler whose output is trusted markup
+type SafeCommandHandler func(Scope) (SafeHTML, error)
+
+// A DotHandler transforms the Scope of any tag using the dot command it was
+// registered for
+type DotHandler func(Scope) Scope
+
+// A BlockHandler receives the Scope of a block tag along with its contents as
+// an executable Template. It is responsible for rendering the contents, which
+// permits it to use a different set of handlers for them.
+type BlockHandler func(scope Scope, contents *Template) (string, error)
+
+// A ContextHandler is a CommandHandler which also receives the Context the
+// Template is being executed with
+type ContextHandler func(ctx context.Context, scope Scope) (string, error)
+
+// A BlockContextHandler is a BlockHandler which also receives the Context the
+// Template is being executed with. It should render the contents with
+// Template.ExecuteContext to pass ctx along.
+type BlockContextHandler func(ctx context.Context, scope Scope, contents *Template) (string, error)
+
+// A StreamHandler writes the final output of a Braai tag directly to w
+type StreamHandler func(ctx context.Context, w io.Writer, scope Scope) error
+
+// A BlockStreamHandler writes the output of a block tag directly to w. It is
+// responsible for rendering the contents, usually with
+// Template.ExecuteToContext.
+type BlockStreamHandler func(ctx context.Context, w io.Writer, scope Scope, contents *Template) error
+
+// A KeyFunc declares the keys a tag needs loaded before it is executed, based
+// on the Scope of the tag
+type KeyFunc func(Scope) []string
+
+// A BatchLoader loads every key declared for a tag at once, returning the
+// loaded value for each key
+type BatchLoader func(ctx context.Context, keys []string) (map[string]interface{}, error)
+
+// A HandleMux is a collection of the handlers used for transforming particular
+// Braai tags into strings.
+type HandleMux struct {
+	mux *parse.HandlerMux
+}
+
+// NewHandleMux returns a new, empty HandleMux. The output of each tag is
+// escaped to suit the HTML surrounding it, such as for a URL within an href
+// attribute, unless a different policy is set using Escaping.
+func NewHandleMux() *HandleMux {
+	mux := parse.NewHandlerMux()
+	mux.Escaping(EscapeContextual)
+	return &HandleMux{mux}
+}
+
+// Escaping sets the policy used to escape the output of CommandHandlers and
+// ContextHandlers. The output of block and stream handlers is never escaped.
+func (h *HandleMux) Escaping(policy Escaping) {
+	h.mux.Escaping(policy)
+}
+
+// Handle registers a CommandHandler for the Braai tag named ident
+func (h *HandleMux) Handle(ident string, f CommandHandler) {
+	h.mux.HandleScope(ident, parse.ScopeHandlerFunc(f))
+}
+
+// HandleSafe registers a SafeCommandHandler for the Braai tag named ident.
+// Its output is never escaped.
+func (h *HandleMux) HandleSafe(ident string, f SafeCommandHandler) {
+	h.mux.HandleSafeScope(ident, f)
+}
+
+// HandleDot registers a DotHandler for the dot command named name
+func (h *HandleMux) HandleDot(name string, f DotHandler) {
+	h.mux.HandleDot(name, parse.DotHandlerFunc(f))
+}
+
+// HandleBlock registers a BlockHandler for the block tag named ident
+func (h *HandleMux) HandleBlock(ident string, f BlockHandler) {
+	h.mux.HandleBlockFunc(ident, func(b *parse.BlockTagNode) (string, error) {
+		scope := Scope{Tag: b.Name, Env: make(map[string]string)}
+		return f(scope, &Template{name: b.Name, root: b.Subtree})
+	})
+}
+
+// HandleContext registers a ContextHandler for the Braai tag named ident
+func (h *HandleMux) HandleContext(ident string, f ContextHandler) {
+	h.mux.HandleContextScope(ident, f)
+}
+
+// HandleBlockContext registers a BlockContextHandler for the block tag named
+// ident
+func (h *HandleMux) HandleBlockContext(ident string, f BlockContextHandler) {
+	h.mux.HandleBlockContextFunc(ident, func(ctx context.Context, b *parse.BlockTagNode) (string, error) {
+		scope := Scope{Tag: b.Name, Env: make(map[string]string)}
+		return f(ctx, scope, &Template{name: b.Name, root: b.Subtree})
+	})
+}
+
+// HandleStream registers a StreamHandler for the Braai tag named ident
+func (h *HandleMux) HandleStream(ident string, f StreamHandler) {
+	h.mux.HandleStreamScope(ident, f)
+}
+
+// HandleBlockStream registers a BlockStreamHandler for the block tag named
+// ident
+func (h *HandleMux) HandleBlockStream(ident string, f BlockStreamHandler) {
+	h.mux.HandleBlockStreamFunc(ident, func(ctx context.Context, w io.Writer, b *parse.BlockTagNode) error {
+		scope := Scope{Tag: b.Name, Env: make(map[string]string)}
+		return f(ctx, w, scope, &Template{name: b.Name, root: b.Subtree})
+	})
+}
+
+// HandleBatch registers a KeyFunc and BatchLoader for the Braai tag named
+// ident, to be used by Template.Prefetch. Tags whose Scope cannot be built
+// declare no keys.
+func (h *HandleMux) HandleBatch(ident string, keys KeyFunc, load BatchLoader) {
+	h.mux.HandleBatch(ident, func(b *parse.BraaiTagNode) []string {
+		scope, err := h.mux.Scope(b)
+		if err != nil {
+			return nil
+		}
+		return keys(scope)
+	}, parse.BatchLoadFunc(load))
+}
+
+// DefineSchema registers the schema of the Braai tag named ident. Attributes
+// omitted from a tag are given their defaults before its Scope is built, and
+// Template.Validate reports any tag which does not conform to the schema.
+func (h *HandleMux) DefineSchema(ident string, schema TagSchema) {
+	h.mux.DefineSchema(ident, schema)
+}
+
+// DefaultHandler registers a CommandHandler which is invoked for any Braai tag
+// which has no handler of its own
+func (h *HandleMux) DefaultHandler(f CommandHandler) {
+	h.mux.DefaultScopeHandler(parse.ScopeHandlerFunc(f))
+}
+
+// ErrorPlaceholder registers a function which renders the placeholder for
+// malformed tags in Templates parsed with Recover
+func (h *HandleMux) ErrorPlaceholder(f func(*ErrorNode) string) {
+	h.mux.ErrorPlaceholder(f)
+}
+
+// Catalog lists every tag and block tag registered with this HandleMux, along
+// with the metadata of their schemas. It is intended to be encoded as JSON for
+// use by editors.
+func (h *HandleMux) Catalog() Catalog {
+	return h.mux.Catalog()
+}
+
+// BlockHandlers returns the identifiers of every registered block tag. It is
+// intended to be passed to Template.Parse.
+func (h *HandleMux) BlockHandlers() []string {
+	return h.mux.BlockHandlers()
+}
@@ -0,0 +1,122 @@
+package parse
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// A Catalog lists every tag registered with a HandlerMux, so that editors can
+// discover them. It is intended to be encoded as JSON, e.g. for autocompletion
+// in a CMS.
+type Catalog struct {
+	Tags []TagInfo `json:"tags"`
+	// DotCommands lists the dot commands registered with HandleDot, which are
+	// available to every tag registered with HandleScope or its variants
+	DotCommands []string `json:"dot_commands,omitempty"`
+}
+
+// A TagInfo describes a single tag within a Catalog. The Description,
+// Arguments, and Attributes are taken from the TagSchema of the tag, if any.
+// DotCommands are taken from the TagSchema, or from the methods of the
+// handler registered using Handle.
+type TagInfo struct {
+	Name        string                 `json:"name"`
+	Block       bool                   `json:"block,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	DotCommands []string               `json:"dot_commands,omitempty"`
+	Arguments   []ValueSchema          `json:"arguments,omitempty"`
+	Variadic    bool                   `json:"variadic,omitempty"`
+	Attributes  map[string]ValueSchema `json:"attributes,omitempty"`
+}
+
+// Catalog returns a Catalog of every tag and block tag registered with this
+// HandlerMux, sorted by name
+func (h *HandlerMux) Catalog() Catalog {
+	var catalog Catalog
+	tags := make(map[string]bool)
+	for name := range h.funcs {
+		tags[name] = true
+	}
+	for name := range h.ctxFuncs {
+		tags[name] = true
+	}
+	for name := range h.streamFuncs {
+		tags[name] = true
+	}
+	for _, name := range h.BlockHandlers() {
+		catalog.Tags = append(catalog.Tags, h.tagInfo(name, true))
+	}
+	for name := range tags {
+		catalog.Tags = append(catalog.Tags, h.tagInfo(name, false))
+	}
+	sort.SliceStable(catalog.Tags, func(i, j int) bool {
+		return catalog.Tags[i].Name < catalog.Tags[j].Name
+	})
+
+	for name := range h.dotFuncs {
+		catalog.DotCommands = append(catalog.DotCommands, name)
+	}
+	sort.Strings(catalog.DotCommands)
+	return catalog
+}
+
+// tagInfo describes the tag named ident
+func (h *HandlerMux) tagInfo(ident string, block bool) TagInfo {
+	info := TagInfo{Name: ident, Block: block}
+	if schema := h.GetSchema(ident); schema != nil {
+		info.Description = schema.Description
+		info.DotCommands = schema.DotCommands
+		info.Arguments = schema.Arguments
+		info.Variadic = schema.Variadic
+		info.Attributes = schema.Attributes
+	}
+	if reg := h.registration(ident); !block && info.DotCommands == nil && reg.reflected != nil {
+		info.DotCommands = dotCommands(reflect.TypeOf(reg.reflected))
+	}
+	return info
+}
+
+// dotCommands lists the dot commands which can be invoked on a handler of
+// type typ, i.e. those methods which return a value and an optional error.
+// The String and Error methods of fmt.Stringer and error are excluded, since
+// they describe the handler rather than being intended for editors.
+func dotCommands(typ reflect.Type) (cmds []string) {
+	if typ.Kind() != reflect.Ptr && typ.Kind() != reflect.Interface {
+		typ = reflect.PtrTo(typ)
+	}
+	for i := 0; i < typ.NumMethod(); i++ {
+		method := typ.Method(i)
+		fnType, ok := methodType(typ, method.Name)
+		if !ok || !returnsValue(fnType) {
+			continue
+		}
+		if (method.Name == "String" || method.Name == "Error") && fnType == stringMethodType {
+			continue
+		}
+		cmds = append(cmds, dotCommandName(method.Name))
+	}
+	return cmds
+}
+
+// stringMethodType is the type of the String method of fmt.Stringer, and of
+// the Error method of error, excluding the receiver
+var stringMethodType = reflect.TypeOf(func() string { return "" })
+
+// dotCommandName converts the name of a method such as ManufacturerSpecs into
+// the dot command which invokes it, manufacturer_specs. It is the inverse of
+// methodName.
+func dotCommandName(method string) string {
+	var name strings.Builder
+	for i, r := range method {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				name.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		name.WriteRune(r)
+	}
+	return name.String()
+}
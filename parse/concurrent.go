@@ -0,0 +1,133 @@
+package parse
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+)
+
+// A ConcurrentExecutor executes the tags of a document in parallel, which is
+// useful when their handlers spend most of their time waiting on other
+// services. Every BraaiTagNode and BlockTagNode at the top level of the
+// document is executed in its own goroutine, and its output is buffered so
+// that the document is still assembled in order. Tags within a block are left
+// to the block's handler, which may use a ConcurrentExecutor on its Subtree.
+//
+// Handlers, including those of the HandlerMux's DotHandlerFuncs, must be safe
+// for concurrent use. The zero value executes every tag at once and reports
+// the first error.
+type ConcurrentExecutor struct {
+	// Workers limits the number of tags executed at once. Zero means there is
+	// no limit.
+	Workers int
+	// AllErrors causes every error to be reported as an ErrorList, rather than
+	// only the first error in document order. Without it, tags following a
+	// failed tag are cancelled.
+	AllErrors bool
+}
+
+// A result holds the output of a single Node executed by a ConcurrentExecutor
+type result struct {
+	buf    bytes.Buffer
+	err    error
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Execute executes node with mux, collecting its output into a string
+func (e *ConcurrentExecutor) Execute(ctx context.Context, node Node, mux *HandlerMux) (string, error) {
+	var buf bytes.Buffer
+	err := e.ExecuteTo(ctx, &buf, node, mux)
+	return buf.String(), err
+}
+
+// ExecuteTo executes node with mux, writing its output to w once every tag has
+// been executed. Should a tag fail, the output preceding it is written along
+// with anything the tag wrote itself, matching the output of
+// Node.ExecuteToContext. Nodes other than a DocumentNode are executed
+// directly.
+func (e *ConcurrentExecutor) ExecuteTo(ctx context.Context, w io.Writer, node Node, mux *HandlerMux) error {
+	doc, ok := node.(*DocumentNode)
+	if !ok {
+		return node.ExecuteToContext(ctx, w, mux)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	results := make([]*result, len(doc.NodeList))
+	for i := range results {
+		r := &result{}
+		r.ctx, r.cancel = context.WithCancel(ctx)
+		results[i] = r
+	}
+	defer func() {
+		for _, r := range results {
+			r.cancel()
+		}
+	}()
+
+	// Cancelling only the tags following a failure ensures that the first
+	// error in document order is the same regardless of scheduling
+	fail := func(i int) {
+		if e.AllErrors {
+			return
+		}
+		for _, r := range results[i+1:] {
+			r.cancel()
+		}
+	}
+
+	var workers chan struct{}
+	if e.Workers > 0 {
+		workers = make(chan struct{}, e.Workers)
+	}
+	var wg sync.WaitGroup
+	for i, child := range doc.NodeList {
+		r := results[i]
+		switch child.(type) {
+		case *BraaiTagNode, *BlockTagNode:
+		default:
+			if r.err = child.ExecuteToContext(r.ctx, &r.buf, mux); r.err != nil {
+				fail(i)
+			}
+			continue
+		}
+
+		if workers != nil {
+			workers <- struct{}{}
+		}
+		wg.Add(1)
+		go func(i int, child Node, r *result) {
+			defer wg.Done()
+			if workers != nil {
+				defer func() { <-workers }()
+			}
+			if r.err = r.ctx.Err(); r.err != nil {
+				return
+			}
+			if r.err = child.ExecuteToContext(r.ctx, &r.buf, mux); r.err != nil {
+				fail(i)
+			}
+		}(i, child, r)
+	}
+	wg.Wait()
+
+	var errs ErrorList
+	for _, r := range results {
+		if _, err := w.Write(r.buf.Bytes()); err != nil {
+			return err
+		}
+		if r.err != nil {
+			if !e.AllErrors {
+				return r.err
+			}
+			errs = append(errs, r.err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
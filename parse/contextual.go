@@ -0,0 +1,426 @@
+package parse
+
+import "strings"
+
+// AnalyzeEscaping determines the Escaping required by every BraaiTag within
+// node from the HTML of the TextNodes preceding it, in the spirit of
+// html/template, recording it in the Escaping field of the tag. Tags in HTML
+// text or comments, or within a textarea or title element, require
+// EscapeHTML, and tags within attribute values require EscapeAttribute,
+// unless the attribute holds a URL. A tag at the start of such an attribute,
+// or of a candidate URL within srcset, requires EscapeFullURL, and one later
+// in the URL requires EscapeURL. Tags amongst the attributes of an HTML tag
+// require EscapeAttribute.
+//
+// Within script elements and event handler attributes such as onclick, a tag
+// in a JavaScript expression requires EscapeJS, or EscapeJSAttribute, and a
+// tag in a string literal or comment requires EscapeJSString. Within style
+// elements and style attributes, a tag requires EscapeCSS, or EscapeCSSString
+// in a string or comment. Tags which cannot be escaped safely, such as those
+// in a JavaScript template literal or regular expression, or in an unquoted
+// event handler or style attribute, require EscapeUnsafe.
+//
+// The output of tags is assumed not to change the HTML context, which holds
+// when it is escaped. The contents of block tags are analyzed as though the
+// block tag were absent. Execute the node with a HandlerMux whose policy is
+// EscapeContextual to apply the results.
+func AnalyzeEscaping(node Node) {
+	node.Visit(&escapeAnalyzer{})
+}
+
+// An htmlState is the position of an escapeAnalyzer within HTML
+type htmlState int
+
+const (
+	stateText        htmlState = iota // HTML text
+	stateTag                          // inside an HTML tag, between attributes
+	stateAttrName                     // within the name of an attribute
+	stateAfterName                    // after the name of an attribute
+	stateBeforeValue                  // after the = of an attribute
+	stateValue                        // within the value of an attribute
+	stateComment                      // within an HTML comment
+	stateRCDATA                       // within a textarea or title element, which holds only text
+	stateScript                       // within a script element
+	stateStyle                        // within a style element
+)
+
+// urlAttributes are the attributes whose values are URLs
+var urlAttributes = map[string]bool{
+	"action":     true,
+	"background": true,
+	"cite":       true,
+	"codebase":   true,
+	"data":       true,
+	"formaction": true,
+	"href":       true,
+	"longdesc":   true,
+	"manifest":   true,
+	"poster":     true,
+	"src":        true,
+	"srcset":     true,
+	"usemap":     true,
+}
+
+// An escapeAnalyzer is the Visitor used by AnalyzeEscaping. It follows the
+// HTML state of the document through each TextNode.
+type escapeAnalyzer struct {
+	state    htmlState
+	element  string // the name of the element being opened, or "" for a closing tag
+	quote    byte   // the delimiter of the attribute value, or 0 if unquoted
+	attr     string // the name of the current attribute
+	valueLen int    // the length of the attribute value, or of the current URL of a srcset, so far
+	js       jsState
+	css      cssState
+}
+
+// AcceptTag records the Escaping required in the current state
+func (a *escapeAnalyzer) AcceptTag(b *BraaiTagNode) {
+	switch a.state {
+	case stateText, stateComment, stateRCDATA:
+		b.Escaping = EscapeHTML
+	case stateScript:
+		b.Escaping = a.js.escaping(EscapeJS)
+	case stateStyle:
+		b.Escaping = a.css.escaping()
+	case stateBeforeValue, stateValue:
+		if a.state == stateBeforeValue {
+			a.beginValue(0)
+		}
+		switch {
+		case (a.scriptAttr() || a.styleAttr()) && a.quote == 0:
+			b.Escaping = EscapeUnsafe
+		case a.scriptAttr():
+			b.Escaping = a.js.escaping(EscapeJSAttribute)
+		case a.styleAttr():
+			b.Escaping = a.css.escaping()
+		case urlAttributes[a.attr] && a.valueLen == 0:
+			b.Escaping = EscapeFullURL
+		case urlAttributes[a.attr]:
+			b.Escaping = EscapeURL
+		case a.quote != 0:
+			b.Escaping = EscapeHTML
+		default:
+			b.Escaping = EscapeAttribute
+		}
+		a.valueLen++
+	default:
+		b.Escaping = EscapeAttribute
+		a.state = stateTag
+	}
+}
+
+// scriptAttr reports whether the current attribute is an event handler, whose
+// value is JavaScript
+func (a *escapeAnalyzer) scriptAttr() bool {
+	return strings.HasPrefix(a.attr, "on")
+}
+
+// styleAttr reports whether the value of the current attribute is CSS
+func (a *escapeAnalyzer) styleAttr() bool {
+	return a.attr == "style"
+}
+
+// beginValue enters the value of the current attribute, delimited by quote
+func (a *escapeAnalyzer) beginValue(quote byte) {
+	a.state, a.quote, a.valueLen = stateValue, quote, 0
+	a.js, a.css = jsState{}, cssState{}
+}
+
+// endTag returns the state following the > of an HTML tag, which depends on
+// the element it opened
+func (a *escapeAnalyzer) endTag() htmlState {
+	switch a.element {
+	case "script":
+		a.js = jsState{}
+		return stateScript
+	case "style":
+		a.css = cssState{}
+		return stateStyle
+	case "textarea", "title":
+		return stateRCDATA
+	default:
+		return stateText
+	}
+}
+
+// AcceptBlockTag is a no-op, since the contents of a block have already been
+// analyzed
+func (a *escapeAnalyzer) AcceptBlockTag(b *BlockTagNode) {
+	// NOP
+}
+
+// AcceptTextNode advances the state through the text
+func (a *escapeAnalyzer) AcceptTextNode(t *TextNode) {
+	text := t.Text
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch a.state {
+		case stateText:
+			if c != '<' || i+1 == len(text) {
+				continue
+			}
+			if strings.HasPrefix(string(text[i+1:]), "!--") {
+				a.state = stateComment
+				i += len("!--")
+			} else if next := text[i+1]; next == '/' || isASCIILetter(next) {
+				a.state = stateTag
+				start := i + 1
+				for i+1 < len(text) && !isHTMLSpace(text[i+1]) && text[i+1] != '>' {
+					i++ // skip the name of the HTML tag
+				}
+				a.element = strings.ToLower(string(text[start : i+1]))
+				if next == '/' {
+					a.element = ""
+				}
+			}
+		case stateComment:
+			if strings.HasPrefix(string(text[i:]), "-->") {
+				a.state = stateText
+				i += len("--")
+			}
+		case stateRCDATA, stateScript, stateStyle:
+			// the element ends at its closing tag, wherever it appears
+			if c == '<' && hasPrefixFold(text[i:], "</"+a.element) {
+				a.state, a.element = stateTag, ""
+				for i+1 < len(text) && !isHTMLSpace(text[i+1]) && text[i+1] != '>' {
+					i++ // skip the name of the closing tag
+				}
+			} else if a.state == stateScript {
+				a.js.next(c)
+			} else if a.state == stateStyle {
+				a.css.next(c)
+			}
+		case stateTag, stateAfterName:
+			switch {
+			case c == '>':
+				a.state = a.endTag()
+			case c == '=' && a.state == stateAfterName:
+				a.state = stateBeforeValue
+			case isHTMLSpace(c) || c == '/':
+			default:
+				a.state, a.attr = stateAttrName, strings.ToLower(string(c))
+			}
+		case stateAttrName:
+			switch {
+			case c == '>':
+				a.state = a.endTag()
+			case c == '=':
+				a.state = stateBeforeValue
+			case isHTMLSpace(c):
+				a.state = stateAfterName
+			default:
+				a.attr += strings.ToLower(string(c))
+			}
+		case stateBeforeValue:
+			switch {
+			case c == '>':
+				a.state = a.endTag()
+			case c == '"' || c == '\'':
+				a.beginValue(c)
+			case isHTMLSpace(c):
+			default:
+				a.beginValue(0)
+				a.value(c)
+			}
+		case stateValue:
+			switch {
+			case a.quote != 0 && c == a.quote:
+				a.state = stateTag
+			case a.quote == 0 && isHTMLSpace(c):
+				a.state = stateTag
+			case a.quote == 0 && c == '>':
+				a.state = a.endTag()
+			default:
+				a.value(c)
+			}
+		}
+	}
+}
+
+// value advances through the character c of an attribute value
+func (a *escapeAnalyzer) value(c byte) {
+	switch {
+	case a.scriptAttr():
+		a.js.next(c)
+	case a.styleAttr():
+		a.css.next(c)
+	case a.attr == "srcset" && c == ',':
+		a.valueLen = 0 // a new candidate URL follows
+	case a.attr == "srcset" && a.valueLen == 0 && isHTMLSpace(c):
+	default:
+		a.valueLen++
+	}
+}
+
+// hasPrefixFold reports whether text begins with prefix, ignoring case
+func hasPrefixFold(text []byte, prefix string) bool {
+	return len(text) >= len(prefix) && strings.EqualFold(string(text[:len(prefix)]), prefix)
+}
+
+func isASCIILetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// A jsState is the position of an escapeAnalyzer within JavaScript. Like
+// html/template, it distinguishes a / which begins a regular expression from
+// one which divides by the token preceding it.
+type jsState struct {
+	quote   byte   // the delimiter of the string or template literal, if within one
+	comment byte   // '/' within a line comment, or '*' within a block comment
+	regexp  bool   // whether within a regular expression literal
+	class   bool   // whether within a character class of a regular expression
+	escaped bool   // whether the previous character was a backslash
+	slash   bool   // whether the previous character was a / yet to be classified
+	star    bool   // whether the previous character was a * within a block comment
+	last    byte   // the last character of the expression outside whitespace
+	word    string // the identifier ending at last, if any
+	spaced  bool   // whether whitespace follows last
+}
+
+// regexpKeywords are the keywords after which a / begins a regular expression
+var regexpKeywords = map[string]bool{
+	"await": true, "case": true, "delete": true, "do": true, "else": true,
+	"in": true, "instanceof": true, "new": true, "return": true, "throw": true,
+	"typeof": true, "void": true, "yield": true,
+}
+
+// escaping returns the Escaping required at the current position, where expr
+// is that required within an expression. The output of the tag is treated as
+// a value.
+func (s *jsState) escaping(expr Escaping) Escaping {
+	s.classifySlash()
+	switch {
+	case s.comment != 0, s.quote == '"', s.quote == '\'':
+		return EscapeJSString
+	case s.quote == '`', s.regexp:
+		return EscapeUnsafe
+	default:
+		s.last, s.word, s.spaced = '"', "", false
+		return expr
+	}
+}
+
+// classifySlash decides whether a pending / begins a regular expression or
+// divides, once it is known not to begin a comment
+func (s *jsState) classifySlash() {
+	if !s.slash {
+		return
+	}
+	s.slash = false
+	switch {
+	case s.last == 0, strings.IndexByte("(,=:[!&|?{};+-*%<>~^", s.last) >= 0:
+		s.regexp = true
+	case isJSIdent(s.last):
+		s.regexp = regexpKeywords[s.word]
+	}
+	if !s.regexp {
+		s.last, s.word, s.spaced = '/', "", false
+	}
+}
+
+// next advances through the character c
+func (s *jsState) next(c byte) {
+	if s.slash {
+		if c == '/' || c == '*' {
+			s.slash, s.comment = false, c
+			return
+		}
+		s.classifySlash()
+	}
+	switch {
+	case s.comment == '/':
+		if c == '\n' || c == '\r' {
+			s.comment = 0
+		}
+	case s.comment == '*':
+		if s.star && c == '/' {
+			s.comment = 0
+		}
+		s.star = c == '*'
+	case s.escaped:
+		s.escaped = false
+	case c == '\\' && (s.quote != 0 || s.regexp):
+		s.escaped = true
+	case s.quote != 0:
+		if c == s.quote {
+			s.quote, s.last, s.word, s.spaced = 0, '"', "", false
+		}
+	case s.regexp:
+		switch {
+		case c == '[':
+			s.class = true
+		case c == ']':
+			s.class = false
+		case c == '/' && !s.class:
+			s.regexp, s.last, s.word, s.spaced = false, '"', "", false
+		}
+	case c == '/':
+		s.slash = true
+	case c == '"' || c == '\'' || c == '`':
+		s.quote = c
+	case isHTMLSpace(c):
+		s.spaced = true
+	default:
+		if isJSIdent(c) && isJSIdent(s.last) && !s.spaced {
+			s.word += string(c)
+		} else if isJSIdent(c) {
+			s.word = string(c)
+		} else {
+			s.word = ""
+		}
+		s.last, s.spaced = c, false
+	}
+}
+
+func isJSIdent(c byte) bool {
+	return isASCIILetter(c) || '0' <= c && c <= '9' || c == '_' || c == '$'
+}
+
+// A cssState is the position of an escapeAnalyzer within CSS
+type cssState struct {
+	quote   byte // the delimiter of the string, if within one
+	comment bool // whether within a comment
+	escaped bool // whether the previous character was a backslash
+	slash   bool // whether the previous character was a / outside a comment
+	star    bool // whether the previous character was a * within a comment
+}
+
+// escaping returns the Escaping required at the current position
+func (s *cssState) escaping() Escaping {
+	s.slash = false
+	if s.quote != 0 || s.comment {
+		return EscapeCSSString
+	}
+	return EscapeCSS
+}
+
+// next advances through the character c
+func (s *cssState) next(c byte) {
+	slash := s.slash
+	s.slash = false
+	switch {
+	case s.comment:
+		if s.star && c == '/' {
+			s.comment = false
+		}
+		s.star = c == '*'
+	case s.escaped:
+		s.escaped = false
+	case c == '\\':
+		s.escaped = true
+	case s.quote != 0:
+		if c == s.quote {
+			s.quote = 0
+		}
+	case c == '*' && slash:
+		s.comment, s.star = true, false
+	case c == '/':
+		s.slash = true
+	case c == '"' || c == '\'':
+		s.quote = c
+	}
+}
@@ -0,0 +1,111 @@
+package parse
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A SyntaxError reports a problem encountered while lexing or parsing a Braai
+// document. When the problem is an unexpected token, Expected and Actual
+// describe the kinds of tokens involved, e.g. "identifier" or "end of tag".
+type SyntaxError struct {
+	Pos      Position
+	Msg      string
+	Lexical  bool   // whether the problem was found by the lexer
+	Expected string // the kind of token the parser expected, if any
+	Actual   string // the kind of token the parser encountered, if any
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Lexical {
+		return e.Pos.String() + ": Lexical Error - " + e.Msg
+	}
+	return e.Pos.String() + ": " + e.Msg
+}
+
+// An UndefinedHandlerError reports a Braai tag, or block tag, for which no
+// handler was registered with the HandlerMux
+type UndefinedHandlerError struct {
+	Pos   Position
+	Tag   string
+	Block bool // whether the tag is a block tag
+}
+
+func (e *UndefinedHandlerError) Error() string {
+	if e.Block {
+		return e.Pos.String() + ": Exec error - Block Handler not defined for tag: " + e.Tag
+	}
+	return e.Pos.String() + ": Exec error - Handler not defined for tag: " + e.Tag
+}
+
+// A SchemaError reports a Braai tag which does not conform to the TagSchema
+// registered for it. Pos is the position of the offending dot command,
+// argument or attribute, or of the tag itself if something is missing.
+type SchemaError struct {
+	Pos Position
+	Tag string
+	Msg string
+}
+
+func (e *SchemaError) Error() string {
+	return e.Pos.String() + ": Schema error - " + e.Msg
+}
+
+// A HandlerError reports an error returned by the handler of a Braai tag, or
+// a failure to invoke a reflected handler. Err is the underlying cause.
+type HandlerError struct {
+	Pos Position
+	Tag string
+	Err error
+}
+
+func (e *HandlerError) Error() string {
+	return e.Pos.String() + ": Exec error - " + e.Err.Error()
+}
+
+// Unwrap returns the cause of the HandlerError
+func (e *HandlerError) Unwrap() error {
+	return e.Err
+}
+
+// handlerError wraps an error returned by the handler of the tag at pos in a
+// HandlerError. Errors which already identify the tag responsible, such as
+// those returned while a block handler executes its Subtree, are returned as
+// is.
+func handlerError(pos Position, tag string, err error) error {
+	var handlerErr *HandlerError
+	var undefinedErr *UndefinedHandlerError
+	if err == nil || errors.As(err, &handlerErr) || errors.As(err, &undefinedErr) {
+		return err
+	}
+	return &HandlerError{Pos: pos, Tag: tag, Err: err}
+}
+
+// tokenKinds describes each itemType for use in error messages
+var tokenKinds = map[itemType]string{
+	itemText:                  "text",
+	itemLeftMeta:              "start of tag",
+	itemRightMeta:             "end of tag",
+	itemBlock:                 "block tag",
+	itemCloser:                "closing tag",
+	itemParenthesizedArgument: "parenthesized argument",
+	itemQuotedArgument:        "quoted argument",
+	itemBracketedArgument:     "bracketed argument",
+	itemDotCommand:            "dot command",
+	itemAssign:                "=",
+	itemIdentifier:            "identifier",
+	itemEOF:                   "end of document",
+	itemError:                 "error",
+	itemComment:               "comment",
+}
+
+// describe returns the kind of tok along with its value, for use in error
+// messages
+func describe(tok item) string {
+	switch tok.Type {
+	case itemRightMeta, itemEOF, itemAssign:
+		return tokenKinds[tok.Type]
+	default:
+		return fmt.Sprintf("%s %q", tokenKinds[tok.Type], tok.Value)
+	}
+}
@@ -0,0 +1,230 @@
+package parse
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// An Escaping is a policy for escaping the output of handlers, chosen to suit
+// the context the rendered document is placed in
+type Escaping int
+
+const (
+	EscapeNone        Escaping = iota // output is used verbatim
+	EscapeHTML                        // output is escaped for HTML text
+	EscapeAttribute                   // output is escaped for HTML attribute values, quoted or not
+	EscapeURL                         // output is escaped for URL query components
+	EscapeFullURL                     // output is a complete URL within an HTML attribute
+	EscapeContextual                  // output is escaped according to the Escaping of each tag
+	EscapeJS                          // output is a JavaScript string literal within a script element
+	EscapeJSAttribute                 // output is a JavaScript string literal within an event handler attribute
+	EscapeJSString                    // output is escaped for JavaScript string literals and comments
+	EscapeCSS                         // output is a CSS value, which is replaced by ZgotmplZ if unsafe
+	EscapeCSSString                   // output is escaped for CSS strings and comments
+	EscapeUnsafe                      // output is replaced by ZgotmplZ, since it cannot be escaped safely
+)
+
+var escapingNames = map[Escaping]string{
+	EscapeNone:        "none",
+	EscapeHTML:        "html",
+	EscapeAttribute:   "attribute",
+	EscapeURL:         "url",
+	EscapeFullURL:     "full_url",
+	EscapeContextual:  "contextual",
+	EscapeJS:          "js",
+	EscapeJSAttribute: "js_attribute",
+	EscapeJSString:    "js_string",
+	EscapeCSS:         "css",
+	EscapeCSSString:   "css_string",
+	EscapeUnsafe:      "unsafe",
+}
+
+func (e Escaping) String() string {
+	if name, ok := escapingNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("Escaping(%d)", int(e))
+}
+
+// SafeHTML is markup from a trusted source. Handlers registered with Handle
+// may return SafeHTML to prevent their output from being escaped, as may
+// those registered with HandleSafeFunc.
+type SafeHTML string
+
+// A SafeHandlerFunc is a HandlerFunc whose output is trusted, and is therefore
+// never escaped
+type SafeHandlerFunc func(*BraaiTagNode) (SafeHTML, error)
+
+// attributeEscaper escapes everything which could end an attribute value,
+// whether or not it is quoted
+var attributeEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	`"`, "&#34;",
+	"'", "&#39;",
+	"`", "&#96;",
+	"=", "&#61;",
+	" ", "&#32;",
+	"\t", "&#9;",
+	"\n", "&#10;",
+	"\r", "&#13;",
+	"\f", "&#12;",
+)
+
+// safeSchemes are the URL schemes permitted by EscapeFullURL
+var safeSchemes = map[string]bool{"http": true, "https": true, "mailto": true}
+
+// unsafeURL replaces URLs rejected by EscapeFullURL
+const unsafeURL = "#unsafe-url"
+
+// unsafeContent replaces output which cannot be escaped safely for where it
+// appears, as in html/template
+const unsafeContent = "ZgotmplZ"
+
+// cssKeywords are those which are unsafe within a CSS value, since they can
+// execute script in some browsers
+var cssKeywords = []string{"expression", "mozbinding"}
+
+// Escaping sets the policy used to escape the output of the handlers of
+// Braai tags. With EscapeContextual, each tag is escaped according to its
+// Escaping field, as determined by AnalyzeEscaping, or for HTML text if it
+// has not been analyzed. The output of block handlers, stream handlers, and error
+// placeholders is never escaped, since it is expected to contain markup;
+// handlers of these kinds are responsible for escaping any untrusted data
+// themselves.
+func (h *HandlerMux) Escaping(policy Escaping) {
+	h.escaping = policy
+}
+
+// HandleSafeFunc registers a SafeHandlerFunc with this HandlerMux
+func (h *HandlerMux) HandleSafeFunc(ident string, f SafeHandlerFunc) {
+	h.funcs[ident] = HandlerFunc(func(b *BraaiTagNode) (string, error) {
+		safe, err := f(b)
+		return string(safe), err
+	})
+	h.registrations[ident] = registration{escaped: true}
+}
+
+// Escape escapes text according to the policy of this HandlerMux. With
+// EscapeContextual, text is escaped for HTML text.
+func (h *HandlerMux) Escape(text string) string {
+	return escapeText(h.escaping, text)
+}
+
+// escapeText escapes text according to policy
+func escapeText(policy Escaping, text string) string {
+	switch policy {
+	case EscapeHTML, EscapeContextual:
+		return html.EscapeString(text)
+	case EscapeAttribute:
+		return attributeEscaper.Replace(text)
+	case EscapeURL:
+		return url.QueryEscape(text)
+	case EscapeFullURL:
+		if i := strings.IndexAny(text, ":/?#"); i >= 0 && text[i] == ':' {
+			if !safeSchemes[strings.ToLower(text[:i])] {
+				return unsafeURL
+			}
+		}
+		return attributeEscaper.Replace(text)
+	case EscapeJS:
+		return `"` + escapeJSString(text) + `"`
+	case EscapeJSAttribute:
+		return "&#34;" + escapeJSString(text) + "&#34;"
+	case EscapeJSString:
+		return escapeJSString(text)
+	case EscapeCSS:
+		return filterCSS(text)
+	case EscapeCSSString:
+		return escapeCSSString(text)
+	case EscapeUnsafe:
+		return unsafeContent
+	default:
+		return text
+	}
+}
+
+// escapeJSString escapes text for a JavaScript string literal, replacing
+// every character which could end the literal, or the script or attribute
+// containing it, with an escape sequence
+func escapeJSString(text string) string {
+	var buf strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '\\':
+			buf.WriteString(`\\`)
+		case r < ' ', r == '\u2028', r == '\u2029', strings.ContainsRune("\"'`&<>=/+", r):
+			fmt.Fprintf(&buf, `\u%04X`, r)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// filterCSS returns text if it is a safe CSS value, such as a color, length
+// or keyword, and unsafeContent otherwise
+func filterCSS(text string) string {
+	for _, r := range text {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(" #%.,-_!", r) {
+			return unsafeContent
+		}
+	}
+	lower := strings.ToLower(text)
+	for _, keyword := range cssKeywords {
+		if strings.Contains(lower, keyword) {
+			return unsafeContent
+		}
+	}
+	return text
+}
+
+// escapeCSSString escapes text for a CSS string, replacing every character
+// other than letters, digits and spaces with a hexadecimal escape sequence
+func escapeCSSString(text string) string {
+	var buf strings.Builder
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == ' ' {
+			buf.WriteRune(r)
+		} else {
+			// the space ends the escape sequence, and is not part of the string
+			fmt.Fprintf(&buf, `\%x `, r)
+		}
+	}
+	return buf.String()
+}
+
+// escapeTag escapes text produced for the BraaiTag according to the policy
+// of this HandlerMux
+func (h *HandlerMux) escapeTag(b *BraaiTagNode, text string) string {
+	if h.escaping == EscapeContextual && b.Escaping != EscapeNone {
+		return escapeText(b.Escaping, text)
+	}
+	return h.Escape(text)
+}
+
+// escapeOutput escapes the output of the HandlerFunc of the BraaiTag, unless
+// the HandlerFunc has escaped it already. The output of a ContextHandlerFunc,
+// which takes precedence over the HandlerFunc, is always escaped.
+func (h *HandlerMux) escapeOutput(b *BraaiTagNode, output string) string {
+	if h.registrations[b.Text].escaped {
+		return output
+	}
+	return h.escapeTag(b, output)
+}
+
+// escapeValue renders the result of a handler registered with Handle,
+// escaping it unless it is SafeHTML
+func (h *HandlerMux) escapeValue(b *BraaiTagNode, value reflect.Value) string {
+	if value.IsValid() && value.CanInterface() {
+		if safe, ok := value.Interface().(SafeHTML); ok {
+			return string(safe)
+		}
+	}
+	return h.escapeTag(b, render(value))
+}
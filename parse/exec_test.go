@@ -1,9 +1,16 @@
 package parse_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	brush "github.com/timraymond/brush/parse"
@@ -46,7 +53,7 @@ func Test_DiesIfNoHandler(t *testing.T) {
 	if assert.NoError(t, err) {
 		_, err = ast.Execute(handlers)
 		if assert.Error(t, err) {
-			assert.Equal(t, "exectest:1:14: Exec error - Handler not defined for tag: [greeting]", err.Error())
+			assert.Equal(t, "exectest:1:13: Exec error - Handler not defined for tag: greeting", err.Error())
 		}
 	}
 }
@@ -93,7 +100,14 @@ func Test_WithDotCommandsShouldExplode(t *testing.T) {
 	if assert.NoError(t, err) {
 		_, err = ast.Execute(handlers)
 		if assert.Error(t, err) {
-			assert.Equal(t, "Undefined method `Verb` for product handler", err.Error())
+			assert.Equal(t, "exectest:1:37: Exec error - Undefined method `Verb` for product handler", err.Error())
+		}
+
+		// the error is positioned even when the handler is invoked directly
+		tag := ast.(*brush.DocumentNode).NodeList[3].(*brush.BraaiTagNode)
+		_, err = handlers.Get("product")(tag)
+		if assert.Error(t, err) {
+			assert.Equal(t, "exectest:1:37: Exec error - Undefined method `Verb` for product handler", err.Error())
 		}
 	}
 }
@@ -198,3 +212,1329 @@ func ExampleCompositeVisitor() {
 	fmt.Println(testVisitor)
 	// Output: Here are my ids: 4815162342, 8675309
 }
+
+func Test_ScopeHandlers(t *testing.T) {
+	const doc string = `{{article.attachments(12345).popup}} {{article attachment_id="12345", mode="popup"}} {{article.popup mode="inline"}}`
+
+	handlers := brush.NewHandlerMux()
+	handlers.HandleDot("attachments", func(scope brush.Scope) brush.Scope {
+		scope.Env["attachment_id"] = scope.Argument
+		return scope
+	})
+	handlers.HandleDot("popup", func(scope brush.Scope) brush.Scope {
+		scope.Env["mode"] = "popup"
+		return scope
+	})
+	handlers.HandleScope("article", func(scope brush.Scope) (string, error) {
+		return scope.Env["mode"] + ":" + scope.Env["attachment_id"], nil
+	})
+
+	ast, err := brush.New("exectest", doc, []string{}).Parse()
+	if assert.NoError(t, err) {
+		result, err := ast.Execute(handlers)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "popup:12345 popup:12345 popup:", result)
+		}
+	}
+}
+
+func Test_ScopeHandlersRightToLeft(t *testing.T) {
+	const doc string = `{{greeting.formal.casual}}`
+
+	handlers := brush.NewHandlerMux()
+	handlers.HandleDot("formal", func(scope brush.Scope) brush.Scope {
+		scope.Env["greeting"] = "Good day"
+		return scope
+	})
+	handlers.HandleDot("casual", func(scope brush.Scope) brush.Scope {
+		scope.Env["greeting"] = "Hey"
+		return scope
+	})
+	handlers.HandleScope("greeting", func(scope brush.Scope) (string, error) {
+		return scope.Env["greeting"], nil
+	})
+
+	ast, err := brush.New("exectest", doc, []string{}).Parse()
+	if assert.NoError(t, err) {
+		result, err := ast.Execute(handlers)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Good day", result)
+		}
+	}
+}
+
+func Test_ScopeHandlersUndefinedDot(t *testing.T) {
+	const doc string = `{{article.sideways}}`
+
+	handlers := brush.NewHandlerMux()
+	handlers.HandleScope("article", func(scope brush.Scope) (string, error) {
+		return "article", nil
+	})
+
+	ast, err := brush.New("exectest", doc, []string{}).Parse()
+	if assert.NoError(t, err) {
+		_, err = ast.Execute(handlers)
+		if assert.Error(t, err) {
+			assert.Equal(t, "exectest:1:1: Exec error - Dot handler not defined for `sideways` in article tag", err.Error())
+		}
+	}
+}
+
+type Spec struct {
+	Name  string
+	Value string
+}
+
+func (s Spec) Label() string {
+	return s.Name + ": " + s.Value
+}
+
+type SpecSheet map[string]string
+
+func (s SpecSheet) Specs(name string) (Spec, error) {
+	if value, ok := s[name]; ok {
+		return Spec{name, value}, nil
+	}
+	return Spec{}, fmt.Errorf("No spec named %s", name)
+}
+
+func (s SpecSheet) ManufacturerSpecs() SpecSheet {
+	return s
+}
+
+func (s SpecSheet) String() string {
+	return fmt.Sprintf("%d specs", len(s))
+}
+
+func Test_WithChainedDotCommands(t *testing.T) {
+	const doc string = "{{product.specs['Color'].label}}, {{product.manufacturer_specs.specs['Weight'].label}}, {{product}}"
+
+	handlers := brush.NewHandlerMux()
+	handlers.Handle("product", SpecSheet{"Color": "Red", "Weight": "2kg"})
+
+	ast, err := brush.New("exectest", doc, []string{}).Parse()
+	if assert.NoError(t, err) {
+		result, err := ast.Execute(handlers)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Color: Red, Weight: 2kg, 2 specs", result)
+		}
+	}
+}
+
+func Test_WithChainedDotCommandErrors(t *testing.T) {
+	const doc string = "{{product.specs['Size'].label}}"
+
+	handlers := brush.NewHandlerMux()
+	handlers.Handle("product", SpecSheet{"Color": "Red"})
+
+	ast, err := brush.New("exectest", doc, []string{}).Parse()
+	if assert.NoError(t, err) {
+		_, err = ast.Execute(handlers)
+		if assert.Error(t, err) {
+			assert.Equal(t, "exectest:1:1: Exec error - No spec named Size", err.Error())
+		}
+	}
+}
+
+type NilProducts struct{}
+
+func (n NilProducts) Iface() fmt.Stringer {
+	return nil
+}
+
+func (n NilProducts) Ptr() *Spec {
+	return nil
+}
+
+func (n NilProducts) Shelf() *Shelf {
+	return nil
+}
+
+type Shelf []Spec
+
+func (s *Shelf) Count() int {
+	if s == nil {
+		return 0
+	}
+	return len(*s)
+}
+
+func Test_WithChainedDotCommandsOnNil(t *testing.T) {
+	handlers := brush.NewHandlerMux()
+	handlers.Handle("product", NilProducts{})
+
+	tests := map[string]string{
+		"{{product.iface.string}}": "exectest:1:1: Exec error - Dot command `string` invoked on a nil value",
+		"{{product.ptr.label}}":    "exectest:1:1: Exec error - Dot command `label` invoked on a nil value",
+	}
+	for doc, expected := range tests {
+		ast, err := brush.New("exectest", doc, []string{}).Parse()
+		if assert.NoError(t, err) {
+			_, err = ast.Execute(handlers)
+			var handlerErr *brush.HandlerError
+			if assert.True(t, errors.As(err, &handlerErr), doc) {
+				assert.Equal(t, expected, err.Error())
+			}
+		}
+	}
+
+	// methods with pointer receivers may handle nil themselves
+	ast, err := brush.New("exectest", "{{product.shelf.count}}", []string{}).Parse()
+	if assert.NoError(t, err) {
+		result, err := ast.Execute(handlers)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "0", result)
+		}
+	}
+}
+
+type GalleryOptions struct {
+	Size    string `brush:"size"`
+	Caption bool   `brush:"include_caption"`
+	Columns int
+}
+
+type Gallery struct{}
+
+func (g Gallery) Photos(id int, names []string, opts GalleryOptions) string {
+	return fmt.Sprintf("%d %s %s %t %d", id, strings.Join(names, "+"), opts.Size, opts.Caption, opts.Columns)
+}
+
+func (g Gallery) Scale(factor float64) float64 {
+	return factor * 2
+}
+
+func (g Gallery) Reset() {}
+
+func Test_TypedArgumentBinding(t *testing.T) {
+	const doc string = `{{gallery.photos(42) "Ashtray", "Doorknob" size="big", include_caption=true, columns="3"}} {{gallery.scale "1.5"}} {{resize(300) crop="true"}}`
+
+	handlers := brush.NewHandlerMux()
+	handlers.Handle("gallery", Gallery{})
+	handlers.Handle("resize", func(width uint, opts *struct{ Crop bool }) string {
+		return fmt.Sprintf("%dpx %t", width, opts.Crop)
+	})
+
+	ast, err := brush.New("exectest", doc, []string{}).Parse()
+	if assert.NoError(t, err) {
+		result, err := ast.Execute(handlers)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "42 Ashtray+Doorknob big true 3 3 300px true", result)
+		}
+	}
+}
+
+func Test_TypedArgumentBindingErrors(t *testing.T) {
+	tests := []struct {
+		doc      string
+		errorMsg string
+	}{
+		{`{{gallery.photos(forty)}}`, "exectest:1:17: Exec error - Cannot bind argument \"forty\" to `Photos`: expected an integer"},
+		{`{{gallery.photos(42) columns="many"}}`, "exectest:1:22: Exec error - Cannot bind attribute columns=\"many\" to `Photos`: expected an integer"},
+		{`{{gallery.scale}}`, "exectest:1:1: Exec error - Missing argument 1 to `Scale`"},
+		{`{{gallery.scale(2) "3"}}`, "exectest:1:20: Exec error - Too many arguments to `Scale`, [\"3\"] unused"},
+		{`{{gallery.scale "big"}}`, "exectest:1:17: Exec error - Cannot bind argument \"big\" to `Scale`: expected a number"},
+		{`{{gallery.reset}}`, "exectest:1:1: Exec error - Cannot call `Reset`, which must return a value and an optional error"},
+	}
+
+	handlers := brush.NewHandlerMux()
+	handlers.Handle("gallery", Gallery{})
+
+	for _, test := range tests {
+		ast, err := brush.New("exectest", test.doc, []string{}).Parse()
+		if assert.NoError(t, err) {
+			_, err = ast.Execute(handlers)
+			if assert.Error(t, err) {
+				assert.Equal(t, test.errorMsg, err.Error())
+			}
+		}
+	}
+}
+
+func Test_EscapedText(t *testing.T) {
+	const doc string = `Use \{{name}} to print {{name}}, or {{{{raw}}}}{{name}} and {{/name}}{{{{/raw}}}}`
+
+	handlers := brush.NewHandlerMux()
+	handlers.HandleFunc("name", func(tag *brush.BraaiTagNode) (string, error) {
+		return "tim", nil
+	})
+
+	ast, err := brush.New("exectest", doc, []string{}).Parse()
+	if assert.NoError(t, err) {
+		result, err := ast.Execute(handlers)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Use {{name}} to print tim, or {{name}} and {{/name}}", result)
+		}
+	}
+}
+
+type CommentCollector struct {
+	TestVisitor
+	Comments []string
+}
+
+func (cc *CommentCollector) AcceptComment(comment *brush.CommentNode) {
+	cc.Comments = append(cc.Comments, comment.Text)
+}
+
+func Test_Comments(t *testing.T) {
+	const doc string = "Price: {{! double check this }}{{price}}{{!\n  and this\n}}"
+
+	handlers := brush.NewHandlerMux()
+	handlers.HandleFunc("price", func(tag *brush.BraaiTagNode) (string, error) {
+		return "$100", nil
+	})
+
+	ast, err := brush.New("exectest", doc, []string{}).Parse()
+	if assert.NoError(t, err) {
+		result, err := ast.Execute(handlers)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Price: $100", result)
+		}
+
+		collector := &CommentCollector{}
+		ast.Visit(brush.NewCompositeVisitor(collector, &TestVisitor{}))
+		assert.Equal(t, []string{"double check this", "and this"}, collector.Comments)
+	}
+}
+
+func Test_CustomDelimiters(t *testing.T) {
+	const doc string = "Angular says {{ greeting }}, Braai says [[greeting]] in a [[bold]][[name]][[/bold]]"
+
+	handlers := brush.NewHandlerMux()
+	handlers.HandleFunc("greeting", func(tag *brush.BraaiTagNode) (string, error) {
+		return "hello", nil
+	})
+	handlers.HandleFunc("name", func(tag *brush.BraaiTagNode) (string, error) {
+		return "tim", nil
+	})
+	handlers.HandleBlockFunc("bold", func(tag *brush.BlockTagNode) (string, error) {
+		subtree, err := tag.Subtree.Execute(handlers)
+		return "<b>" + subtree + "</b>", err
+	})
+
+	ast, err := brush.New("exectest", doc, handlers.BlockHandlers()).Delims("[[", "]]").Parse()
+	if assert.NoError(t, err) {
+		result, err := ast.Execute(handlers)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Angular says {{ greeting }}, Braai says hello in a <b>tim</b>", result)
+		}
+	}
+}
+
+func Test_TrimMarkers(t *testing.T) {
+	tests := []struct {
+		doc      string
+		expected string
+	}{
+		{"Hello,   {{- name -}}  !", "Hello,tim!"},
+		{"Hello, {{name -}}\n\n!", "Hello, tim!"},
+		{"Hello,\n{{- name}} !", "Hello,tim !"},
+		{"Paragraph\n\n{{-callout-}}\n  {{name}}\n{{-/callout-}}\n\nParagraph", "Paragraph<aside>tim</aside>Paragraph"},
+		{"Paragraph\n{{callout}}\n  {{name}}\n{{/callout}}\nParagraph", "Paragraph\n<aside>\n  tim\n</aside>\nParagraph"},
+	}
+
+	handlers := brush.NewHandlerMux()
+	handlers.HandleFunc("name", func(tag *brush.BraaiTagNode) (string, error) {
+		return "tim", nil
+	})
+	handlers.HandleBlockFunc("callout", func(tag *brush.BlockTagNode) (string, error) {
+		subtree, err := tag.Subtree.Execute(handlers)
+		return "<aside>" + subtree + "</aside>", err
+	})
+
+	for _, test := range tests {
+		ast, err := brush.New("exectest", test.doc, handlers.BlockHandlers()).Parse()
+		if assert.NoError(t, err) {
+			result, err := ast.Execute(handlers)
+			if assert.NoError(t, err) {
+				assert.Equal(t, test.expected, result)
+			}
+		}
+	}
+}
+
+func Test_ErrorPlaceholders(t *testing.T) {
+	const doc string = "Buy the {{product.name}} for {{product.price(}} today{{!"
+
+	handlers := brush.NewHandlerMux()
+	handlers.HandleFunc("product", func(tag *brush.BraaiTagNode) (string, error) {
+		return "Canon Foo", nil
+	})
+
+	ast, err := brush.New("exectest", doc, []string{}).Recover().Parse()
+	if assert.Error(t, err) {
+		assert.Len(t, err.(brush.ErrorList), 2)
+	}
+
+	result, err := ast.Execute(handlers)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Buy the Canon Foo for  today", result)
+	}
+
+	handlers.ErrorPlaceholder(func(node *brush.ErrorNode) string {
+		return fmt.Sprintf("[error at %d:%d]", node.Pos.Line, node.Pos.Column)
+	})
+	result, err = ast.Execute(handlers)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Buy the Canon Foo for [error at 1:30] today[error at 1:57]", result)
+	}
+}
+
+func Test_TagErrorf(t *testing.T) {
+	handlers := brush.NewHandlerMux()
+	handlers.HandleFunc("greeting", brush.HandlerFunc(func(tag *brush.BraaiTagNode) (string, error) {
+		return "", tag.Errorf("No greeting for %s", tag.Attributes["name"])
+	}))
+
+	ast, err := brush.New("exectest", `Hi {{greeting name="tim"}}`, []string{}).Parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = ast.Execute(handlers)
+	var handlerErr *brush.HandlerError
+	if assert.True(t, errors.As(err, &handlerErr)) {
+		assert.Equal(t, "greeting", handlerErr.Tag)
+		assert.Equal(t, "No greeting for tim", handlerErr.Err.Error())
+		assert.Equal(t, "exectest:1:4: Exec error - No greeting for tim", err.Error())
+	}
+}
+
+func Test_TypedExecErrors(t *testing.T) {
+	const doc string = "{{greeting}} {{product.name['9000']}}\n{{callout}}{{product.verb}}{{/callout}}"
+
+	handlers := brush.NewHandlerMux()
+	handlers.Handle("product", &ProductHandler{"Canon Foo"})
+
+	ast, err := brush.New("exectest", doc, []string{"callout"}).Parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = ast.Execute(handlers)
+	var undefined *brush.UndefinedHandlerError
+	if assert.True(t, errors.As(err, &undefined)) {
+		assert.Equal(t, "greeting", undefined.Tag)
+		assert.False(t, undefined.Block)
+		assert.Equal(t, 1, undefined.Pos.Column)
+	}
+
+	handlers.HandleFunc("greeting", brush.HandlerFunc(func(tag *brush.BraaiTagNode) (string, error) {
+		return "Hello", nil
+	}))
+	_, err = ast.Execute(handlers)
+	if assert.True(t, errors.As(err, &undefined)) {
+		assert.Equal(t, "callout", undefined.Tag)
+		assert.True(t, undefined.Block)
+	}
+
+	handlers.HandleBlockFunc("callout", func(block *brush.BlockTagNode) (string, error) {
+		return block.Subtree.Execute(handlers)
+	})
+	_, err = ast.Execute(handlers)
+	var handlerErr *brush.HandlerError
+	if assert.True(t, errors.As(err, &handlerErr)) {
+		assert.Equal(t, "product", handlerErr.Tag)
+		assert.Equal(t, 2, handlerErr.Pos.Line)
+		assert.Equal(t, "Undefined method `Verb` for product handler", handlerErr.Err.Error())
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func Test_ExecuteTo(t *testing.T) {
+	const doc string = "A greeting: {{greeting}}, {{name}}!{{! not rendered }}"
+
+	handlers := brush.NewHandlerMux()
+	handlers.HandleFunc("greeting", brush.HandlerFunc(func(tag *brush.BraaiTagNode) (string, error) {
+		return "Hello there", nil
+	}))
+	handlers.HandleStreamFunc("name", func(ctx context.Context, w io.Writer, tag *brush.BraaiTagNode) error {
+		_, err := io.WriteString(w, "tim")
+		return err
+	})
+
+	ast, err := brush.New("exectest", doc, []string{}).Parse()
+	if assert.NoError(t, err) {
+		var buf bytes.Buffer
+		if assert.NoError(t, ast.ExecuteTo(&buf, handlers)) {
+			assert.Equal(t, "A greeting: Hello there, tim!", buf.String())
+		}
+
+		err = ast.ExecuteTo(failingWriter{}, handlers)
+		assert.EqualError(t, err, "connection reset")
+	}
+}
+
+func Test_ExecuteToStreamErrors(t *testing.T) {
+	const doc string = "Before {{callout}}{{review}}{{/callout}} after"
+
+	handlers := brush.NewHandlerMux()
+	handlers.HandleStreamFunc("review", func(ctx context.Context, w io.Writer, tag *brush.BraaiTagNode) error {
+		io.WriteString(w, "partial")
+		return errors.New("review not found")
+	})
+	handlers.HandleBlockStreamFunc("callout", func(ctx context.Context, w io.Writer, block *brush.BlockTagNode) error {
+		return block.Subtree.ExecuteToContext(ctx, w, handlers)
+	})
+
+	ast, err := brush.New("exectest", doc, handlers.BlockHandlers()).Parse()
+	if assert.NoError(t, err) {
+		var buf bytes.Buffer
+		err = ast.ExecuteTo(&buf, handlers)
+		var handlerErr *brush.HandlerError
+		if assert.True(t, errors.As(err, &handlerErr)) {
+			assert.Equal(t, "review", handlerErr.Tag)
+		}
+		assert.Equal(t, "Before partial", buf.String())
+	}
+}
+
+type localeKey struct{}
+
+func Test_ExecuteContext(t *testing.T) {
+	const doc string = "{{callout}}Price: {{price}}{{/callout}} {{stock}}"
+
+	handlers := brush.NewHandlerMux()
+	handlers.HandleContextFunc("price", func(ctx context.Context, tag *brush.BraaiTagNode) (string, error) {
+		if ctx.Value(localeKey{}) == "de" {
+			return "9,99 €", nil
+		}
+		return "$9.99", nil
+	})
+	handlers.HandleBlockContextFunc("callout", func(ctx context.Context, block *brush.BlockTagNode) (string, error) {
+		inner, err := block.Subtree.ExecuteContext(ctx, handlers)
+		return "<aside>" + inner + "</aside>", err
+	})
+	handlers.HandleFunc("stock", brush.HandlerFunc(func(tag *brush.BraaiTagNode) (string, error) {
+		return "In stock", nil
+	}))
+
+	ast, err := brush.New("exectest", doc, handlers.BlockHandlers()).Parse()
+	if assert.NoError(t, err) {
+		ctx := context.WithValue(context.Background(), localeKey{}, "de")
+		result, err := ast.ExecuteContext(ctx, handlers)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "<aside>Price: 9,99 €</aside> In stock", result)
+		}
+
+		result, err = ast.Execute(handlers)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "<aside>Price: $9.99</aside> In stock", result)
+		}
+	}
+}
+
+func Test_ExecuteContextCancelled(t *testing.T) {
+	const doc string = "{{first}} {{second}}"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var called []string
+
+	handlers := brush.NewHandlerMux()
+	handlers.HandleContextFunc("first", func(ctx context.Context, tag *brush.BraaiTagNode) (string, error) {
+		called = append(called, tag.Text)
+		cancel()
+		return "first", nil
+	})
+	handlers.HandleContextFunc("second", func(ctx context.Context, tag *brush.BraaiTagNode) (string, error) {
+		called = append(called, tag.Text)
+		return "second", nil
+	})
+
+	ast, err := brush.New("exectest", doc, []string{}).Parse()
+	if assert.NoError(t, err) {
+		var buf bytes.Buffer
+		err = ast.ExecuteToContext(ctx, &buf, handlers)
+		assert.True(t, errors.Is(err, context.Canceled))
+		assert.Equal(t, []string{"first"}, called)
+		assert.Equal(t, "first", buf.String())
+	}
+}
+
+func Test_ConcurrentExecutor(t *testing.T) {
+	const doc string = "{{product(1)}}, {{product(2)}}, {{callout}}{{product(3)}}{{/callout}} and {{product(4)}}"
+
+	delays := map[string]time.Duration{"1": 20 * time.Millisecond, "2": 15 * time.Millisecond, "4": 5 * time.Millisecond}
+	var mu sync.Mutex
+	var running, peak int
+	handlers := brush.NewHandlerMux()
+	handlers.HandleContextFunc("product", func(ctx context.Context, tag *brush.BraaiTagNode) (string, error) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+
+		// later products respond first
+		id := tag.Arguments[0]
+		time.Sleep(delays[id])
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return "Camera " + id, nil
+	})
+	handlers.HandleBlockContextFunc("callout", func(ctx context.Context, block *brush.BlockTagNode) (string, error) {
+		inner, err := block.Subtree.ExecuteContext(ctx, handlers)
+		return "[" + inner + "]", err
+	})
+
+	ast, err := brush.New("exectest", doc, handlers.BlockHandlers()).Parse()
+	if assert.NoError(t, err) {
+		executor := &brush.ConcurrentExecutor{Workers: 2}
+		result, err := executor.Execute(context.Background(), ast, handlers)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Camera 1, Camera 2, [Camera 3] and Camera 4", result)
+		}
+		assert.Equal(t, 2, peak)
+	}
+}
+
+func Test_ConcurrentExecutorErrors(t *testing.T) {
+	const doc string = "{{slow}} {{broken(first)}} {{broken(second)}} {{fine}}"
+
+	handlers := brush.NewHandlerMux()
+	handlers.HandleContextFunc("slow", func(ctx context.Context, tag *brush.BraaiTagNode) (string, error) {
+		time.Sleep(10 * time.Millisecond)
+		return "slow", nil
+	})
+	handlers.HandleContextFunc("broken", func(ctx context.Context, tag *brush.BraaiTagNode) (string, error) {
+		if tag.Arguments[0] == "first" {
+			time.Sleep(5 * time.Millisecond)
+		}
+		return "", fmt.Errorf("%s is broken", tag.Arguments[0])
+	})
+	handlers.HandleContextFunc("fine", func(ctx context.Context, tag *brush.BraaiTagNode) (string, error) {
+		return "fine", nil
+	})
+
+	ast, err := brush.New("exectest", doc, []string{}).Parse()
+	if assert.NoError(t, err) {
+		var buf bytes.Buffer
+		executor := &brush.ConcurrentExecutor{}
+		err = executor.ExecuteTo(context.Background(), &buf, ast, handlers)
+		assert.EqualError(t, err, "exectest:1:10: Exec error - first is broken")
+		assert.Equal(t, "slow ", buf.String())
+
+		executor.AllErrors = true
+		_, err = executor.Execute(context.Background(), ast, handlers)
+		if errs, ok := err.(brush.ErrorList); assert.True(t, ok) && assert.Len(t, errs, 2) {
+			assert.EqualError(t, errs[0], "exectest:1:10: Exec error - first is broken")
+			assert.EqualError(t, errs[1], "exectest:1:28: Exec error - second is broken")
+		}
+	}
+}
+
+func Test_Prefetch(t *testing.T) {
+	const doc string = "{{attachment(12)}} {{callout}}{{attachment(34)}}{{/callout}} {{attachment(12)}} {{photo(7)}}"
+
+	var batches [][]string
+	handlers := brush.NewHandlerMux()
+	handlers.HandleBatch("attachment", func(tag *brush.BraaiTagNode) []string {
+		return tag.Arguments
+	}, func(ctx context.Context, keys []string) (map[string]interface{}, error) {
+		batches = append(batches, keys)
+		values := make(map[string]interface{})
+		for _, key := range keys {
+			values[key] = "attachment-" + key + ".jpg"
+		}
+		return values, nil
+	})
+	handlers.HandleContextFunc("attachment", func(ctx context.Context, tag *brush.BraaiTagNode) (string, error) {
+		value, ok := brush.Loaded(ctx, "attachment", tag.Arguments[0])
+		if !ok {
+			return "", tag.Errorf("attachment %s was not loaded", tag.Arguments[0])
+		}
+		return value.(string), nil
+	})
+	handlers.HandleBlockContextFunc("callout", func(ctx context.Context, block *brush.BlockTagNode) (string, error) {
+		return block.Subtree.ExecuteContext(ctx, handlers)
+	})
+	handlers.HandleFunc("photo", brush.HandlerFunc(func(tag *brush.BraaiTagNode) (string, error) {
+		return "photo", nil
+	}))
+
+	ast, err := brush.New("exectest", doc, handlers.BlockHandlers()).Parse()
+	if assert.NoError(t, err) {
+		ctx, err := brush.Prefetch(context.Background(), ast, handlers)
+		if assert.NoError(t, err) {
+			assert.Equal(t, [][]string{{"12", "34"}}, batches)
+
+			result, err := ast.ExecuteContext(ctx, handlers)
+			if assert.NoError(t, err) {
+				assert.Equal(t, "attachment-12.jpg attachment-34.jpg attachment-12.jpg photo", result)
+			}
+		}
+
+		_, err = ast.Execute(handlers)
+		assert.EqualError(t, err, "exectest:1:1: Exec error - attachment 12 was not loaded")
+	}
+}
+
+func Test_PrefetchTwice(t *testing.T) {
+	handlers := brush.NewHandlerMux()
+	handlers.HandleBatch("attachment", func(tag *brush.BraaiTagNode) []string {
+		return tag.Arguments
+	}, func(ctx context.Context, keys []string) (map[string]interface{}, error) {
+		values := make(map[string]interface{})
+		for _, key := range keys {
+			values[key] = "attachment-" + key + ".jpg"
+		}
+		return values, nil
+	})
+
+	first, err := brush.New("exectest", "{{attachment(12)}}", []string{}).Parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	second, err := brush.New("exectest", "{{attachment(34)}}", []string{}).Parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ctx, err := brush.Prefetch(context.Background(), first, handlers)
+	if !assert.NoError(t, err) {
+		return
+	}
+	merged, err := brush.Prefetch(ctx, second, handlers)
+	if assert.NoError(t, err) {
+		value, ok := brush.Loaded(merged, "attachment", "12")
+		assert.True(t, ok)
+		assert.Equal(t, "attachment-12.jpg", value)
+		value, ok = brush.Loaded(merged, "attachment", "34")
+		assert.True(t, ok)
+		assert.Equal(t, "attachment-34.jpg", value)
+	}
+	_, ok := brush.Loaded(ctx, "attachment", "34")
+	assert.False(t, ok)
+}
+
+func Test_PrefetchErrors(t *testing.T) {
+	handlers := brush.NewHandlerMux()
+	handlers.HandleBatch("product", func(tag *brush.BraaiTagNode) []string {
+		return tag.Arguments
+	}, func(ctx context.Context, keys []string) (map[string]interface{}, error) {
+		return nil, errors.New("catalog unavailable")
+	})
+
+	ast, err := brush.New("exectest", "{{product(1)}}", []string{}).Parse()
+	if assert.NoError(t, err) {
+		_, err = brush.Prefetch(context.Background(), ast, handlers)
+		assert.EqualError(t, err, "Batch load failed for product tags: catalog unavailable")
+	}
+}
+
+func Test_Validate(t *testing.T) {
+	const doc string = "{{gallery.photos(forty)}} {{product.specs['Size'].label}}\n" +
+		"{{callout}}{{product.specs['Size'].shout}}{{/callout}} {{sidebar}}{{missing}}{{/sidebar}}\n" +
+		"{{gallery.scale}} {{article.popup}} {{name}} {{gallery.photos(1) columns=\"3\"}}"
+
+	handlers := brush.NewHandlerMux()
+	handlers.Handle("gallery", Gallery{})
+	handlers.Handle("product", SpecSheet{})
+	handlers.HandleScope("article", func(scope brush.Scope) (string, error) {
+		return "", nil
+	})
+	handlers.HandleFunc("name", brush.HandlerFunc(func(tag *brush.BraaiTagNode) (string, error) {
+		return "tim", nil
+	}))
+	handlers.HandleBlockFunc("callout", func(block *brush.BlockTagNode) (string, error) {
+		return block.Subtree.Execute(handlers)
+	})
+
+	ast, err := brush.New("exectest", doc, []string{"callout", "sidebar"}).Parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	err = brush.Validate(ast, handlers)
+	errs, ok := err.(brush.ErrorList)
+	if !assert.True(t, ok, "expected an ErrorList, saw %T", err) {
+		return
+	}
+	expected := []string{
+		"exectest:1:17: Exec error - Cannot bind argument \"forty\" to `Photos`: expected an integer",
+		"exectest:2:12: Exec error - Undefined method `Shout` for product handler",
+		"exectest:2:56: Exec error - Block Handler not defined for tag: sidebar",
+		"exectest:2:67: Exec error - Handler not defined for tag: missing",
+		"exectest:3:1: Exec error - Missing argument 1 to `Scale`",
+		"exectest:3:19: Exec error - Dot handler not defined for `popup` in article tag",
+	}
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	assert.Equal(t, expected, messages)
+
+	var undefined *brush.UndefinedHandlerError
+	if assert.True(t, errors.As(errs[2], &undefined)) {
+		assert.True(t, undefined.Block)
+	}
+
+	handlers.DefaultHandler(func(tag *brush.BraaiTagNode) (string, error) {
+		return "", nil
+	})
+	ast, err = brush.New("exectest", "{{gallery.photos(1)}} {{anything.at_all}}", []string{}).Parse()
+	if assert.NoError(t, err) {
+		assert.NoError(t, brush.Validate(ast, handlers))
+	}
+}
+
+func Test_ValidateScopeHandlers(t *testing.T) {
+	handlers := brush.NewHandlerMux()
+	handlers.HandleContextScope("name", func(ctx context.Context, scope brush.Scope) (string, error) {
+		return "tim", nil
+	})
+	handlers.HandleFunc("name", brush.HandlerFunc(func(tag *brush.BraaiTagNode) (string, error) {
+		return "tim", nil
+	}))
+
+	ast, err := brush.New("exectest", "{{name.upper}}", []string{}).Parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualError(t, brush.Validate(ast, handlers), "exectest:1:1: Exec error - Dot handler not defined for `upper` in name tag")
+
+	// a ContextHandlerFunc may handle dot commands itself
+	handlers.HandleContextFunc("name", func(ctx context.Context, tag *brush.BraaiTagNode) (string, error) {
+		return "TIM", nil
+	})
+	assert.NoError(t, brush.Validate(ast, handlers))
+}
+
+func Test_ValidateNestedBlocks(t *testing.T) {
+	const doc string = "{{a}} {{outer}}{{b}}{{inner}}{{c}}{{/inner}}{{/outer}} {{d}}"
+
+	ast, err := brush.New("exectest", doc, []string{"outer", "inner"}).Parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	errs, ok := brush.Validate(ast, brush.NewHandlerMux()).(brush.ErrorList)
+	if !assert.True(t, ok) {
+		return
+	}
+	expected := []string{
+		"exectest:1:1: Exec error - Handler not defined for tag: a",
+		"exectest:1:7: Exec error - Block Handler not defined for tag: outer",
+		"exectest:1:16: Exec error - Handler not defined for tag: b",
+		"exectest:1:21: Exec error - Block Handler not defined for tag: inner",
+		"exectest:1:30: Exec error - Handler not defined for tag: c",
+		"exectest:1:56: Exec error - Handler not defined for tag: d",
+	}
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	assert.Equal(t, expected, messages)
+}
+
+func Test_Schemas(t *testing.T) {
+	const doc string = "{{gallery.photos(42) incude_caption=true}}\n" +
+		"{{gallery.photos(7) size=\"huge\", columns=\"two\"}} {{gallery.slideshow(7)}} {{gallery.photos}}"
+
+	handlers := brush.NewHandlerMux()
+	handlers.Handle("gallery", Gallery{})
+	handlers.DefineSchema("gallery", brush.TagSchema{
+		DotCommands: []string{"photos"},
+		Arguments:   []brush.ValueSchema{{Type: brush.StringValue}},
+		Variadic:    true,
+		Attributes: map[string]brush.ValueSchema{
+			"size":            {Enum: []string{"small", "big"}, Default: "small"},
+			"include_caption": {Type: brush.BoolValue},
+			"columns":         {Type: brush.IntValue, Default: "3"},
+		},
+	})
+
+	ast, err := brush.New("exectest", doc, []string{}).Parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	err = brush.Validate(ast, handlers)
+	errs, ok := err.(brush.ErrorList)
+	if !assert.True(t, ok, "expected an ErrorList, saw %T", err) {
+		return
+	}
+	expected := []string{
+		"exectest:1:22: Schema error - Unknown attribute incude_caption for gallery tag",
+		"exectest:2:21: Schema error - Attribute size=\"huge\" to gallery tag: expected one of small, big",
+		"exectest:2:34: Schema error - Attribute columns=\"two\" to gallery tag: expected an integer",
+		"exectest:2:59: Schema error - Unknown dot command `slideshow` for gallery tag",
+		"exectest:2:75: Exec error - Missing argument 1 to `Photos`",
+	}
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	assert.Equal(t, expected, messages)
+
+	var schemaErr *brush.SchemaError
+	if assert.True(t, errors.As(errs[0], &schemaErr)) {
+		assert.Equal(t, "gallery", schemaErr.Tag)
+	}
+
+	ast, err = brush.New("exectest", `{{gallery.photos(42) include_caption=true}} {{gallery.photos(1) size="big", columns="2"}}`, []string{}).Parse()
+	if assert.NoError(t, err) {
+		assert.NoError(t, brush.Validate(ast, handlers))
+		result, err := ast.Execute(handlers)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "42  small true 3 1  big false 2", result)
+		}
+	}
+}
+
+func Test_SchemaUnknownValueType(t *testing.T) {
+	handlers := brush.NewHandlerMux()
+	handlers.Handle("gallery", Gallery{})
+	handlers.DefineSchema("gallery", brush.TagSchema{
+		Arguments: []brush.ValueSchema{{Type: 99}},
+	})
+
+	ast, err := brush.New("exectest", `{{gallery.scale "2"}}`, []string{}).Parse()
+	if assert.NoError(t, err) {
+		err = brush.Validate(ast, handlers)
+		if errs, ok := err.(brush.ErrorList); assert.True(t, ok) && assert.Len(t, errs, 1) {
+			assert.EqualError(t, errs[0], "exectest:1:17: Schema error - Argument 1 \"2\" to gallery tag: unknown type ValueType(99) in schema")
+		}
+	}
+}
+
+func Test_Catalog(t *testing.T) {
+	handlers := brush.NewHandlerMux()
+	handlers.Handle("product", SpecSheet{})
+	handlers.Handle("gallery", Gallery{})
+	handlers.DefineSchema("gallery", brush.TagSchema{
+		Description: "A gallery of photos",
+		DotCommands: []string{"photos"},
+		Arguments:   []brush.ValueSchema{{Name: "id", Type: brush.IntValue, Required: true}},
+		Attributes: map[string]brush.ValueSchema{
+			"size": {Description: "The size of each photo", Enum: []string{"small", "big"}, Default: "small"},
+		},
+	})
+	handlers.HandleScope("article", func(scope brush.Scope) (string, error) {
+		return "", nil
+	})
+	handlers.HandleDot("popup", func(scope brush.Scope) brush.Scope {
+		return scope
+	})
+	handlers.HandleBlockFunc("callout", func(block *brush.BlockTagNode) (string, error) {
+		return block.Subtree.Execute(handlers)
+	})
+
+	encoded, err := json.Marshal(handlers.Catalog())
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{
+			"tags": [
+				{"name": "article"},
+				{"name": "callout", "block": true},
+				{
+					"name": "gallery",
+					"description": "A gallery of photos",
+					"dot_commands": ["photos"],
+					"arguments": [{"name": "id", "type": "int", "required": true}],
+					"attributes": {
+						"size": {"description": "The size of each photo", "type": "string", "default": "small", "enum": ["small", "big"]}
+					}
+				},
+				{"name": "product", "dot_commands": ["manufacturer_specs", "specs"]}
+			],
+			"dot_commands": ["popup"]
+		}`, string(encoded))
+	}
+
+	var decoded brush.Catalog
+	if assert.NoError(t, json.Unmarshal(encoded, &decoded)) {
+		assert.Equal(t, brush.IntValue, decoded.Tags[2].Arguments[0].Type)
+	}
+}
+
+type Badge struct{}
+
+func (b Badge) Html(label string) brush.SafeHTML {
+	return brush.SafeHTML("<span>" + label + "</span>")
+}
+
+func (b Badge) Text(label string) string {
+	return "<span>" + label + "</span>"
+}
+
+func Test_Escaping(t *testing.T) {
+	const doc string = `{{name title="Tom & Jerry's <Show>"}} {{badge.html(new)}} {{badge.text(new)}} {{logo}} {{callout}}{{unknown}}{{/callout}}`
+
+	handlers := brush.NewHandlerMux()
+	handlers.HandleFunc("name", brush.HandlerFunc(func(tag *brush.BraaiTagNode) (string, error) {
+		return tag.Attributes["title"], nil
+	}))
+	handlers.Handle("badge", Badge{})
+	handlers.HandleSafeFunc("logo", func(tag *brush.BraaiTagNode) (brush.SafeHTML, error) {
+		return `<img src="logo.png">`, nil
+	})
+	handlers.HandleBlockFunc("callout", func(block *brush.BlockTagNode) (string, error) {
+		inner, err := block.Subtree.Execute(handlers)
+		return "<aside>" + inner + "</aside>", err
+	})
+	handlers.DefaultHandler(func(tag *brush.BraaiTagNode) (string, error) {
+		return "<" + tag.Text + ">", nil
+	})
+
+	ast, err := brush.New("exectest", doc, handlers.BlockHandlers()).Parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		policy   brush.Escaping
+		expected string
+	}{
+		{brush.EscapeNone, `Tom & Jerry's <Show> <span>new</span> <span>new</span> <img src="logo.png"> <aside><unknown></aside>`},
+		{brush.EscapeHTML, `Tom &amp; Jerry&#39;s &lt;Show&gt; <span>new</span> &lt;span&gt;new&lt;/span&gt; <img src="logo.png"> <aside>&lt;unknown&gt;</aside>`},
+		{brush.EscapeAttribute, `Tom&#32;&amp;&#32;Jerry&#39;s&#32;&lt;Show&gt; <span>new</span> &lt;span&gt;new&lt;/span&gt; <img src="logo.png"> <aside>&lt;unknown&gt;</aside>`},
+		{brush.EscapeURL, `Tom+%26+Jerry%27s+%3CShow%3E <span>new</span> %3Cspan%3Enew%3C%2Fspan%3E <img src="logo.png"> <aside>%3Cunknown%3E</aside>`},
+	}
+	for _, test := range tests {
+		handlers.Escaping(test.policy)
+		result, err := ast.Execute(handlers)
+		if assert.NoError(t, err) {
+			assert.Equal(t, test.expected, result, "escaping policy %s", test.policy)
+		}
+	}
+}
+
+func Test_EscapingContextHandlerPrecedence(t *testing.T) {
+	ast, err := brush.New("exectest", `{{x v="<script>"}}`, []string{}).Parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	raw := func(ctx context.Context, tag *brush.BraaiTagNode) (string, error) {
+		return tag.Attributes["v"], nil
+	}
+
+	// the context handler takes precedence, so its output is still escaped
+	handlers := brush.NewHandlerMux()
+	handlers.Escaping(brush.EscapeHTML)
+	handlers.HandleContextFunc("x", raw)
+	handlers.HandleSafeFunc("x", func(tag *brush.BraaiTagNode) (brush.SafeHTML, error) {
+		return "safe", nil
+	})
+	result, err := ast.Execute(handlers)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "&lt;script&gt;", result)
+	}
+
+	handlers = brush.NewHandlerMux()
+	handlers.Escaping(brush.EscapeHTML)
+	handlers.HandleContextFunc("x", raw)
+	handlers.Handle("x", Badge{})
+	result, err = ast.Execute(handlers)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "&lt;script&gt;", result)
+	}
+}
+
+func Test_ContextualEscaping(t *testing.T) {
+	const doc string = `<a href="{{link}}">{{name}}</a> <a href="/search?q={{query}}&lang=en" title="{{name}}">` +
+		`{{callout}}<img src={{photo}} alt={{name}}>{{/callout}}</a> <div {{name}}></div> <!-- {{name}} --> <a href='{{home}}'>`
+
+	values := map[string]string{
+		"link":  "javascript:alert(1)",
+		"name":  `Tom & "Jerry"`,
+		"query": "a b&c",
+		"photo": "http://example.com/a b.jpg",
+		"home":  "/",
+	}
+	handlers := brush.NewHandlerMux()
+	handlers.Escaping(brush.EscapeContextual)
+	handlers.DefaultHandler(func(tag *brush.BraaiTagNode) (string, error) {
+		return values[tag.Text], nil
+	})
+	handlers.HandleBlockFunc("callout", func(block *brush.BlockTagNode) (string, error) {
+		return block.Subtree.Execute(handlers)
+	})
+
+	ast, err := brush.New("exectest", doc, handlers.BlockHandlers()).Parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	brush.AnalyzeEscaping(ast)
+
+	var escapings []string
+	var collect func(brush.Node)
+	collect = func(node brush.Node) {
+		switch n := node.(type) {
+		case *brush.DocumentNode:
+			for _, child := range n.NodeList {
+				collect(child)
+			}
+		case *brush.BlockTagNode:
+			collect(n.Subtree)
+		case *brush.BraaiTagNode:
+			escapings = append(escapings, n.Text+":"+n.Escaping.String())
+		}
+	}
+	collect(ast)
+	assert.Equal(t, []string{
+		"link:full_url", "name:html", "query:url", "name:html", "photo:full_url",
+		"name:attribute", "name:attribute", "name:html", "home:full_url",
+	}, escapings)
+
+	result, err := ast.Execute(handlers)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `<a href="#unsafe-url">Tom &amp; &#34;Jerry&#34;</a> `+
+			`<a href="/search?q=a+b%26c&lang=en" title="Tom &amp; &#34;Jerry&#34;">`+
+			`<img src=http://example.com/a&#32;b.jpg alt=Tom&#32;&amp;&#32;&#34;Jerry&#34;></a> `+
+			`<div Tom&#32;&amp;&#32;&#34;Jerry&#34;></div> <!-- Tom &amp; &#34;Jerry&#34; --> <a href='/'>`, result)
+	}
+}
+
+func Test_ContextualEscapingScriptsAndStyles(t *testing.T) {
+	values := map[string]string{
+		"x":     "alert(1)",
+		"quote": `'); alert("1`,
+		"color": "red",
+		"evil":  "expression(alert(1))",
+		"font":  `a'}b`,
+		"link":  "javascript:alert(1)",
+		"photo": "a.jpg",
+		"name":  "<b>",
+	}
+	handlers := brush.NewHandlerMux()
+	handlers.Escaping(brush.EscapeContextual)
+	handlers.DefaultHandler(func(tag *brush.BraaiTagNode) (string, error) {
+		return values[tag.Text], nil
+	})
+
+	tests := []struct {
+		doc       string
+		escapings []string
+		expected  string
+	}{
+		{`<a onclick="f({{x}})">`, []string{"js_attribute"}, `<a onclick="f(&#34;alert(1)&#34;)">`},
+		{`<a onclick='f("{{quote}}")'>`, []string{"js_string"}, `<a onclick='f("\u0027); alert(\u00221")'>`},
+		{`<a onclick={{x}}>`, []string{"unsafe"}, `<a onclick=ZgotmplZ>`},
+		{`<script>var a = {{x}};</script>`, []string{"js"}, `<script>var a = "alert(1)";</script>`},
+		{`<script>if (a<b) { s = '{{quote}}' }</script>{{name}}`, []string{"js_string", "html"},
+			`<script>if (a<b) { s = '\u0027); alert(\u00221' }</script>&lt;b&gt;`},
+		{"<script>// {{x}}\nvar d = a / {{x}} / 2;</script>", []string{"js_string", "js"},
+			"<script>// alert(1)\nvar d = a / \"alert(1)\" / 2;</script>"},
+		{"<script>var t = `${ {{x}} }`, r = /a{{x}}/;</SCRIPT>", []string{"unsafe", "unsafe"},
+			"<script>var t = `${ ZgotmplZ }`, r = /aZgotmplZ/;</SCRIPT>"},
+		{`<script>var r = /'/, s = {{x}};</script>`, []string{"js"}, `<script>var r = /'/, s = "alert(1)";</script>`},
+		{`<p style="color: {{color}}; background: {{evil}}">`, []string{"css", "css"}, `<p style="color: red; background: ZgotmplZ">`},
+		{`<style>p { font-family: '{{font}}' } /* {{font}} */</style>`, []string{"css_string", "css_string"},
+			`<style>p { font-family: 'a\27 \7d b' } /* a\27 \7d b */</style>`},
+		{`<textarea><a href="{{name}}"></textarea><title>{{name}}</title>`, []string{"html", "html"},
+			`<textarea><a href="&lt;b&gt;"></textarea><title>&lt;b&gt;</title>`},
+		{`<img srcset="{{photo}} 1x, {{link}} 2x">`, []string{"full_url", "full_url"}, `<img srcset="a.jpg 1x, #unsafe-url 2x">`},
+	}
+	for _, test := range tests {
+		ast, err := brush.New("exectest", test.doc, []string{}).Parse()
+		if !assert.NoError(t, err) {
+			continue
+		}
+		brush.AnalyzeEscaping(ast)
+
+		var escapings []string
+		for _, node := range ast.(*brush.DocumentNode).NodeList {
+			if tag, ok := node.(*brush.BraaiTagNode); ok {
+				escapings = append(escapings, tag.Escaping.String())
+			}
+		}
+		assert.Equal(t, test.escapings, escapings, test.doc)
+
+		result, err := ast.Execute(handlers)
+		if assert.NoError(t, err) {
+			assert.Equal(t, test.expected, result, test.doc)
+		}
+	}
+}
+
+func Test_Rewrite(t *testing.T) {
+	const doc string = `{{! migrate }}Intro {{brightcove(123) autoplay="true"}} {{callout}}{{brightcove['456']}} {{product.name}}{{/callout}}`
+
+	ast, err := brush.New("exectest", doc, []string{"callout"}).Parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	var visited []string
+	ast = brush.Rewrite(ast, func(node brush.Node) (brush.Node, brush.Action) {
+		switch n := node.(type) {
+		case *brush.CommentNode:
+			return nil, brush.Delete
+		case *brush.BlockTagNode:
+			visited = append(visited, n.Name)
+			return &brush.TextNode{Text: []byte("<hr>")}, brush.InsertBefore
+		case *brush.BraaiTagNode:
+			visited = append(visited, n.Text)
+			if n.Text != "brightcove" {
+				return n, brush.Continue
+			}
+			return &brush.BraaiTagNode{
+				Text:       "video",
+				Attributes: map[string]string{"id": n.Arguments[0], "provider": "brightcove"},
+			}, brush.Continue
+		}
+		return node, brush.Continue
+	})
+	assert.Equal(t, []string{"brightcove", "callout", "brightcove", "product"}, visited)
+
+	var buf bytes.Buffer
+	if assert.NoError(t, brush.Print(&buf, ast)) {
+		assert.Equal(t, `Intro {{video id="123" provider="brightcove"}} <hr>{{callout}}{{video id="456" provider="brightcove"}} {{product.name}}{{/callout}}`, buf.String())
+	}
+}
+
+func Test_RewriteRoot(t *testing.T) {
+	ast, err := brush.New("exectest", "{{callout}}{{x}}{{/callout}}", []string{"callout"}).Parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	deleteAll := func(node brush.Node) (brush.Node, brush.Action) {
+		if _, ok := node.(*brush.DocumentNode); ok {
+			return node, brush.Continue
+		}
+		return nil, brush.Delete
+	}
+	block := ast.(*brush.DocumentNode).NodeList[1].(*brush.BlockTagNode)
+	brush.Rewrite(block, func(node brush.Node) (brush.Node, brush.Action) {
+		if _, ok := node.(*brush.BlockTagNode); ok {
+			return node, brush.Continue
+		}
+		return nil, brush.Delete
+	})
+	if assert.IsType(t, &brush.DocumentNode{}, block.Subtree) {
+		assert.Empty(t, block.Subtree.(*brush.DocumentNode).NodeList)
+	}
+
+	assert.Empty(t, brush.Rewrite(ast, deleteAll).(*brush.DocumentNode).NodeList)
+	assert.Nil(t, brush.Rewrite(&brush.TextNode{}, deleteAll))
+
+	inserted := brush.Rewrite(&brush.TextNode{Text: []byte("b")}, func(node brush.Node) (brush.Node, brush.Action) {
+		return &brush.TextNode{Text: []byte("a")}, brush.InsertBefore
+	})
+	result, err := inserted.Execute(brush.NewHandlerMux())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ab", result)
+	}
+}
+
+// A TestWalker records the nodes it enters, along with the depth of each, and
+// skips the contents of the block tags named in skip
+type TestWalker struct {
+	Events []string
+	skip   string
+}
+
+func describeNode(node brush.Node) string {
+	switch n := node.(type) {
+	case *brush.DocumentNode:
+		return "document"
+	case *brush.BlockTagNode:
+		return "block " + n.Name
+	case *brush.BraaiTagNode:
+		return "tag " + n.Text
+	case *brush.DotCommandNode:
+		return "dot " + n.Text
+	case *brush.SingleArgumentNode:
+		return "argument " + n.Text
+	case *brush.TextNode:
+		return "text " + string(n.Text)
+	}
+	return fmt.Sprintf("%T", node)
+}
+
+func (tw *TestWalker) Enter(node brush.Node, ancestors []brush.Node) bool {
+	tw.Events = append(tw.Events, fmt.Sprintf("%d %s", len(ancestors), describeNode(node)))
+	block, ok := node.(*brush.BlockTagNode)
+	return !ok || block.Name != tw.skip
+}
+
+func (tw *TestWalker) Leave(node brush.Node, ancestors []brush.Node) {
+	tw.Events = append(tw.Events, fmt.Sprintf("%d /%s", len(ancestors), describeNode(node)))
+}
+
+func Test_Walk(t *testing.T) {
+	const doc string = `{{callout}}{{product(1).photo['Big One'] "x"}}{{/callout}}{{aside}}a{{/aside}}`
+
+	ast, err := brush.New("walktest", doc, []string{"callout", "aside"}).Parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	tw := &TestWalker{skip: "aside"}
+	brush.Walk(ast, tw)
+	assert.Equal(t, []string{
+		"0 document",
+		"1 text ",
+		"1 /text ",
+		"1 block callout",
+		"2 document",
+		"3 text ",
+		"3 /text ",
+		"3 tag product",
+		"4 argument 1",
+		"4 /argument 1",
+		"4 dot photo",
+		"5 argument Big One",
+		"5 /argument Big One",
+		"4 /dot photo",
+		"4 argument x",
+		"4 /argument x",
+		"3 /tag product",
+		"3 text ",
+		"3 /text ",
+		"2 /document",
+		"1 /block callout",
+		"1 text ",
+		"1 /text ",
+		"1 block aside",
+		"1 /block aside",
+		"0 /document",
+	}, tw.Events)
+}
+
+// An AncestorWalker reports the name of the block tag containing each tag
+type AncestorWalker struct {
+	Blocks []string
+}
+
+func (aw *AncestorWalker) Enter(node brush.Node, ancestors []brush.Node) bool {
+	if _, ok := node.(*brush.BraaiTagNode); !ok {
+		return true
+	}
+	block := ""
+	for _, ancestor := range ancestors {
+		if b, ok := ancestor.(*brush.BlockTagNode); ok {
+			block = b.Name
+		}
+	}
+	aw.Blocks = append(aw.Blocks, block)
+	return false
+}
+
+func (aw *AncestorWalker) Leave(node brush.Node, ancestors []brush.Node) {}
+
+func Test_WalkCompositeVisitor(t *testing.T) {
+	const doc string = `{{foo id="1"}} {{callout}}{{foo id="2"}}{{aside}}{{foo id="3"}}{{/aside}}{{/callout}}`
+
+	ast, err := brush.New("walktest", doc, []string{"callout", "aside"}).Parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	tv := &TestVisitor{}
+	tw := &TestWalker{skip: "callout"}
+	aw := &AncestorWalker{}
+	brush.Walk(ast, brush.NewCompositeVisitor(tv).AddWalker(tw).AddWalker(aw))
+
+	assert.Equal(t, []string{"1", "2", "3"}, tv.Ids)
+	assert.Equal(t, []string{"", "callout", "aside"}, aw.Blocks)
+	assert.Equal(t, []string{
+		"0 document", "1 text ", "1 /text ", "1 tag foo", "1 /tag foo", "1 text  ", "1 /text  ",
+		"1 block callout", "1 /block callout", "0 /document",
+	}, tw.Events)
+}
@@ -1,17 +1,31 @@
 package parse
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"reflect"
-	"strings"
 )
 
 // A HandlerMux is a collection of the user-specified functions used for
 // transforming particular Braai tags into strings.
 type HandlerMux struct {
-	funcs          map[string]HandlerFunc
-	blockFuncs     map[string]BlockHandlerFunc
-	defaultHandler HandlerFunc
+	funcs            map[string]HandlerFunc
+	blockFuncs       map[string]BlockHandlerFunc
+	ctxFuncs         map[string]ContextHandlerFunc
+	blockCtxFuncs    map[string]BlockContextHandlerFunc
+	streamFuncs      map[string]StreamHandlerFunc
+	blockStreamFuncs map[string]BlockStreamHandlerFunc
+	dotFuncs         map[string]DotHandlerFunc
+	batchLoaders     map[string]batchLoader
+	registrations    map[string]registration // of funcs
+	ctxRegs          map[string]registration // of ctxFuncs
+	streamRegs       map[string]registration // of streamFuncs
+	defaultReg       registration
+	schemas          map[string]*TagSchema
+	escaping         Escaping
+	defaultHandler   HandlerFunc
+	errorPlaceholder func(*ErrorNode) string
 }
 
 // A HandlerFunc is a function which receives the raw BraaiTagNode, and is
@@ -24,14 +38,46 @@ type HandlerFunc func(*BraaiTagNode) (string, error)
 // rendered properly
 type BlockHandlerFunc func(*BlockTagNode) (string, error)
 
+// A ContextHandlerFunc is a HandlerFunc which also receives the Context the
+// document is being executed with, so that it may observe cancellation and
+// request-scoped values
+type ContextHandlerFunc func(ctx context.Context, tag *BraaiTagNode) (string, error)
+
+// A BlockContextHandlerFunc is a BlockHandlerFunc which also receives the
+// Context the document is being executed with. It should pass ctx along by
+// invoking the ExecuteContext() method on the BlockTagNode's Subtree.
+type BlockContextHandlerFunc func(ctx context.Context, block *BlockTagNode) (string, error)
+
+// A StreamHandlerFunc receives the raw BraaiTagNode, and writes the finished
+// content directly to w. It is useful for tags with large output, which would
+// otherwise be buffered in a string. ctx is the Context the document is being
+// executed with.
+type StreamHandlerFunc func(ctx context.Context, w io.Writer, tag *BraaiTagNode) error
+
+// A BlockStreamHandlerFunc receives a BlockTagNode, and writes the finished
+// content directly to w. Like a BlockHandlerFunc, it must invoke the
+// ExecuteToContext() method on the BlockTagNode's Subtree for its children to
+// be rendered.
+type BlockStreamHandlerFunc func(ctx context.Context, w io.Writer, block *BlockTagNode) error
+
+// A registration records how the HandlerFunc of a tag was registered, so that
+// Validate can check tags against it
+type registration struct {
+	reflected interface{} // the handler passed to Handle, if any
+	scoped    bool        // whether the handler was registered with HandleScope or its variants
+	escaped   bool        // whether the HandlerFunc escapes its own output
+}
+
 // HandleFunc registers a HandlerFunc with this HandlerMux
 func (h *HandlerMux) HandleFunc(ident string, f HandlerFunc) {
 	h.funcs[ident] = f
+	delete(h.registrations, ident)
 }
 
 // DefaultHandler is invoked when no Braai tag matches any defined handler
 func (h *HandlerMux) DefaultHandler(f func(*BraaiTagNode) (string, error)) {
 	h.defaultHandler = HandlerFunc(f)
+	h.defaultReg = registration{}
 }
 
 // GetDefaultHandler returns the registered default handler if present, otherwise nil
@@ -39,11 +85,63 @@ func (h *HandlerMux) GetDefaultHandler() HandlerFunc {
 	return h.defaultHandler
 }
 
+// ErrorPlaceholder registers a function which renders the placeholder for the
+// malformed regions of a document parsed in recovery mode. Without one, these
+// regions render as nothing.
+func (h *HandlerMux) ErrorPlaceholder(f func(*ErrorNode) string) {
+	h.errorPlaceholder = f
+}
+
 // HandleBlockFunc registers a BlockHandlerFunc with this HandlerMux
 func (h *HandlerMux) HandleBlockFunc(ident string, f func(*BlockTagNode) (string, error)) {
 	h.blockFuncs[ident] = BlockHandlerFunc(f)
 }
 
+// HandleContextFunc registers a ContextHandlerFunc with this HandlerMux.
+// Context handlers take precedence over any HandlerFunc registered for the
+// same tag.
+func (h *HandlerMux) HandleContextFunc(ident string, f ContextHandlerFunc) {
+	h.ctxFuncs[ident] = f
+	delete(h.ctxRegs, ident)
+}
+
+// HandleBlockContextFunc registers a BlockContextHandlerFunc with this
+// HandlerMux. Context handlers take precedence over any BlockHandlerFunc
+// registered for the same tag.
+func (h *HandlerMux) HandleBlockContextFunc(ident string, f BlockContextHandlerFunc) {
+	h.blockCtxFuncs[ident] = f
+}
+
+// HandleStreamFunc registers a StreamHandlerFunc with this HandlerMux. Stream
+// handlers take precedence over any other handler registered for the same
+// tag.
+func (h *HandlerMux) HandleStreamFunc(ident string, f StreamHandlerFunc) {
+	h.streamFuncs[ident] = f
+	delete(h.streamRegs, ident)
+}
+
+// registration returns the registration of the handler which executes the
+// BraaiTags named ident, following the precedence of ExecuteContext
+func (h *HandlerMux) registration(ident string) registration {
+	switch {
+	case h.streamFuncs[ident] != nil:
+		return h.streamRegs[ident]
+	case h.ctxFuncs[ident] != nil:
+		return h.ctxRegs[ident]
+	case h.funcs[ident] != nil:
+		return h.registrations[ident]
+	default:
+		return h.defaultReg
+	}
+}
+
+// HandleBlockStreamFunc registers a BlockStreamHandlerFunc with this
+// HandlerMux. Stream handlers take precedence over any other block handler
+// registered for the same tag.
+func (h *HandlerMux) HandleBlockStreamFunc(ident string, f BlockStreamHandlerFunc) {
+	h.blockStreamFuncs[ident] = f
+}
+
 // HandleFuncWrap takes a slice strings, naming all types of BraaiTag found in
 // the Subtree of this Block handler, it is expected to return two strings for
 // the prefix and suffix of the rendered subtree's content, and an error,
@@ -56,32 +154,85 @@ func (h *HandlerMux) HandleFuncWrap(ident string, wrap func([]string) (string, s
 // handlers associated with them. This is intended to make it easy to specify
 // which identifiers should be considered block braai tags.
 func (h *HandlerMux) BlockHandlers() (handlers []string) {
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			handlers = append(handlers, name)
+		}
+	}
 	for name, _ := range h.blockFuncs {
-		handlers = append(handlers, name)
+		add(name)
+	}
+	for name, _ := range h.blockCtxFuncs {
+		add(name)
+	}
+	for name, _ := range h.blockStreamFuncs {
+		add(name)
 	}
 	return handlers
 }
 
 // Handle defines a HandlerFunc which introspects the passed in handler,
-// invoking methods matching dot command nodes.
+// invoking methods matching dot command nodes. Dot commands are processed from
+// left to right, with each method invoked on the value returned by the
+// previous one, so that chains such as {{product.specs['Color'].label}} can be
+// modeled naturally. Methods may return either a single value, or a value and
+// an error. The final value is rendered as the output of the tag, so a tag
+// without any dot commands renders the handler itself, or the result of
+// calling it if the handler is a function.
+//
+// The argument of each dot command is bound to the first parameter of its
+// method. The positional arguments and attributes of the tag are bound to the
+// last method in the chain: positional arguments fill the remaining
+// parameters in order, a slice parameter receives every remaining argument,
+// and a struct parameter receives the attributes by matching its `brush`
+// field tags, e.g.:
+//   type GalleryOptions struct {
+//	  Size    string `brush:"size"`
+//	  Caption bool   `brush:"include_caption"`
+//	}
+//
+// Arguments are converted to strings, bools, ints, uints, floats, slices of
+// those types, or pointers to them, as required by the parameter. The final
+// value is escaped according to the Escaping policy, unless it is SafeHTML.
 func (h *HandlerMux) Handle(ident string, handler interface{}) {
+	h.registrations[ident] = registration{reflected: handler, escaped: true}
 	h.funcs[ident] = HandlerFunc(func(b *BraaiTagNode) (string, error) {
-		for _, cmd := range b.DotCommands {
-			method := reflect.ValueOf(handler).MethodByName(strings.Title(cmd.Text))
+		value := reflect.ValueOf(handler)
+		if len(b.DotCommands) == 0 && value.Kind() == reflect.Func {
+			result, err := call(b, ident, value, nil, true)
+			if err != nil {
+				return "", err
+			}
+			return h.escapeValue(b, result), nil
+		}
+		for idx, cmd := range b.DotCommands {
+			name := methodName(cmd.Text)
+			if nilReceiver(value, name) {
+				return "", handlerError(b.Pos, ident, fmt.Errorf("Dot command `%s` invoked on a nil value", cmd.Text))
+			}
+			method := findMethod(value, name)
 			if method.IsValid() == false {
-				return "", fmt.Errorf("Undefined method `%s` for %s handler", strings.Title(cmd.Text), ident)
+				return "", handlerError(b.Pos, ident, undefinedMethod(name, ident))
 			}
-			if cmd.Argument != nil {
-				argument, _ := cmd.Argument.Execute(h)
-				return method.Interface().(func(string) (string, error))(argument)
-			} else {
-				return method.Interface().(func() (string, error))()
+			arg, _ := cmd.Argument.(*SingleArgumentNode)
+			var err error
+			value, err = call(b, name, method, arg, idx == len(b.DotCommands)-1)
+			if err != nil {
+				return "", err
 			}
 		}
-		return "", nil
+		return h.escapeValue(b, value), nil
 	})
 }
 
+// undefinedMethod reports a dot command without a corresponding method on the
+// handler registered for ident using Handle
+func undefinedMethod(name, ident string) error {
+	return fmt.Errorf("Undefined method `%s` for %s handler", name, ident)
+}
+
 // Get returns a previously defined HandlerFunc using either Handle or
 // HandleFunc
 func (h *HandlerMux) Get(name string) HandlerFunc {
@@ -93,6 +244,30 @@ func (h *HandlerMux) GetBlock(name string) BlockHandlerFunc {
 	return h.blockFuncs[name]
 }
 
+// GetContext returns a previously defined ContextHandlerFunc using
+// HandleContextFunc
+func (h *HandlerMux) GetContext(name string) ContextHandlerFunc {
+	return h.ctxFuncs[name]
+}
+
+// GetBlockContext returns a previously defined BlockContextHandlerFunc using
+// HandleBlockContextFunc
+func (h *HandlerMux) GetBlockContext(name string) BlockContextHandlerFunc {
+	return h.blockCtxFuncs[name]
+}
+
+// GetStream returns a previously defined StreamHandlerFunc using
+// HandleStreamFunc
+func (h *HandlerMux) GetStream(name string) StreamHandlerFunc {
+	return h.streamFuncs[name]
+}
+
+// GetBlockStream returns a previously defined BlockStreamHandlerFunc using
+// HandleBlockStreamFunc
+func (h *HandlerMux) GetBlockStream(name string) BlockStreamHandlerFunc {
+	return h.blockStreamFuncs[name]
+}
+
 // NewHandlerMux returns a new HandlerMux with internal maps pre-initialized.
 // All HandlerMuxes should be created this way to ensure future initialization
 // logic is handled
@@ -100,5 +275,15 @@ func NewHandlerMux() *HandlerMux {
 	mux := &HandlerMux{}
 	mux.funcs = make(map[string]HandlerFunc)
 	mux.blockFuncs = make(map[string]BlockHandlerFunc)
+	mux.ctxFuncs = make(map[string]ContextHandlerFunc)
+	mux.blockCtxFuncs = make(map[string]BlockContextHandlerFunc)
+	mux.streamFuncs = make(map[string]StreamHandlerFunc)
+	mux.blockStreamFuncs = make(map[string]BlockStreamHandlerFunc)
+	mux.dotFuncs = make(map[string]DotHandlerFunc)
+	mux.batchLoaders = make(map[string]batchLoader)
+	mux.registrations = make(map[string]registration)
+	mux.ctxRegs = make(map[string]registration)
+	mux.streamRegs = make(map[string]registration)
+	mux.schemas = make(map[string]*TagSchema)
 	return mux
 }
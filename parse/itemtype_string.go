@@ -4,9 +4,9 @@ package parse
 
 import "fmt"
 
-const _itemType_name = "itemTextitemLeftMetaitemRightMetaitemBlockitemCloseritemParenthesizedArgumentitemQuotedArgumentitemBracketedArgumentitemDotCommanditemAssignitemIdentifieritemEOFitemError"
+const _itemType_name = "itemTextitemLeftMetaitemRightMetaitemBlockitemCloseritemParenthesizedArgumentitemQuotedArgumentitemBracketedArgumentitemDotCommanditemAssignitemIdentifieritemEOFitemErroritemComment"
 
-var _itemType_index = [...]uint8{0, 8, 20, 33, 42, 52, 77, 95, 116, 130, 140, 154, 161, 170}
+var _itemType_index = [...]uint8{0, 8, 20, 33, 42, 52, 77, 95, 116, 130, 140, 154, 161, 170, 181}
 
 func (i itemType) String() string {
 	if i < 0 || i+1 >= itemType(len(_itemType_index)) {
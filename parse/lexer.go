@@ -16,6 +16,9 @@ type lexer struct {
 	start               int       // start position in the input of the next token
 	pos                 int       // current position in the input, will mark the end of the next token
 	width               int       // width of the last read rune
+	leftDelim           string    // marks the beginning of a braai tag
+	rightDelim          string    // marks the end of a braai tag
+	resync              bool      // whether to resume lexing after an error
 	spaceAlreadyScanned bool
 }
 
@@ -30,6 +33,11 @@ const filename = "-._()/,&é0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOP
 
 const eof = -1
 
+const (
+	defaultLeftDelim  = "{{"
+	defaultRightDelim = "}}"
+)
+
 //go:generate stringer -type=itemType
 const (
 	itemText      itemType = iota // an unprocessed block of opaque text
@@ -45,6 +53,7 @@ const (
 	itemIdentifier
 	itemEOF
 	itemError
+	itemComment // the contents of a comment tag
 )
 
 // Represents a scanned item. Includes the string value encompassing the item.
@@ -55,12 +64,17 @@ type item struct {
 	Value string
 }
 
+// NextToken returns the next item of the document. Once lexing has stopped,
+// whether at the end of the document or after an error, it returns itemEOF.
 func (self *lexer) NextToken() item {
 	for {
 		select {
 		case item := <-self.items:
 			return item
 		default:
+			if self.state == nil {
+				return item{itemEOF, len(self.input), ""}
+			}
 			self.state = self.state(self)
 		}
 	}
@@ -68,7 +82,37 @@ func (self *lexer) NextToken() item {
 
 // Provides a new lexer for the given document
 func NewLexer(document string, blockIds []string) *lexer {
-	return &lexer{input: document, state: lexText, items: make(chan item, 2), blockIds: blockIds}
+	return &lexer{
+		input:      document,
+		state:      lexText,
+		items:      make(chan item, 2),
+		blockIds:   blockIds,
+		leftDelim:  defaultLeftDelim,
+		rightDelim: defaultRightDelim,
+	}
+}
+
+// delims sets the delimiters used to recognize braai tags. An empty delimiter
+// is replaced by its default.
+func (l *lexer) delims(left, right string) {
+	if left == "" {
+		left = defaultLeftDelim
+	}
+	if right == "" {
+		right = defaultRightDelim
+	}
+	l.leftDelim = left
+	l.rightDelim = right
+}
+
+// rawOpener begins a section which is treated as text, e.g. {{{{raw}}}}
+func (l *lexer) rawOpener() string {
+	return l.leftDelim + l.leftDelim + "raw" + l.rightDelim + l.rightDelim
+}
+
+// rawCloser ends a raw section, e.g. {{{{/raw}}}}
+func (l *lexer) rawCloser() string {
+	return l.leftDelim + l.leftDelim + "/raw" + l.rightDelim + l.rightDelim
 }
 
 // emits a new item into the lexer's items channel
@@ -88,6 +132,7 @@ func (self *lexer) backup() {
 
 func (self *lexer) next() rune {
 	if int(self.pos) >= len(self.input) {
+		self.width = 0 // so that backing up from the end of input stays there
 		return eof
 	}
 	r, w := utf8.DecodeRuneInString(self.input[self.pos:])
@@ -116,38 +161,62 @@ func (l *lexer) peek() rune {
 	return r
 }
 
-func (l *lexer) lineNumber() int {
-	return 1 + strings.Count(l.input[:l.pos], "\n")
-}
-
-func (l *lexer) column() int {
-	lastNewline := strings.LastIndex(l.input[:l.pos], "\n")
-	if lastNewline == -1 {
-		lastNewline = 0
-	}
-
-	var ending int
-	if l.start > len(l.input) {
-		ending = len(l.input)
-	} else {
-		ending = l.start
-	}
-
-	return utf8.RuneCountInString(l.input[lastNewline:ending])
-}
-
 func (l *lexer) ignore() {
 	l.start = l.pos
 }
 
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
 	l.items <- item{itemError, l.start, fmt.Sprintf(format, args...)}
+	if l.resync {
+		return lexResync
+	}
 	return nil
 }
 
+// Discards the remainder of a malformed braai tag from the point of the error,
+// up to and including the next right meta, or up to the end of the line,
+// whichever comes first. Lexing
+// then resumes with the text following it.
+func lexResync(l *lexer) stateFn {
+	l.pos = l.start // the error may have been found after scanning to the end of the input
+	rest := l.input[l.pos:]
+	end := strings.Index(rest, l.rightDelim)
+	if end >= 0 {
+		end += len(l.rightDelim)
+	}
+	if newline := strings.IndexByte(rest, '\n'); newline >= 0 && (end < 0 || newline < end) {
+		end = newline
+	}
+	if end < 0 {
+		end = len(rest)
+	}
+	l.pos += end
+	l.ignore()
+	l.spaceAlreadyScanned = false
+	return lexText
+}
+
+// prefixed to a left meta to treat it as text
+const escape = `\`
+
+// placed inside the delimiters of a braai tag to trim adjacent whitespace
+const trimMarker = "-"
+
 func lexText(l *lexer) stateFn {
 	for {
-		if strings.HasPrefix(l.input[l.pos:], "{{") {
+		if strings.HasPrefix(l.input[l.pos:], escape+l.leftDelim) {
+			if l.pos > l.start {
+				l.emit(itemText)
+			}
+			return lexEscape
+		}
+		if strings.HasPrefix(l.input[l.pos:], l.rawOpener()) {
+			if l.pos > l.start {
+				l.emit(itemText)
+			}
+			return lexRaw
+		}
+		if strings.HasPrefix(l.input[l.pos:], l.leftDelim) {
 			l.emit(itemText)
 			return lexLeftMeta
 		}
@@ -162,8 +231,39 @@ func lexText(l *lexer) stateFn {
 	return nil
 }
 
+// Drops the escape character preceding a left meta, and makes the left meta
+// the beginning of the next text item
+func lexEscape(l *lexer) stateFn {
+	l.pos += len(escape)
+	l.ignore()
+	l.pos += len(l.leftDelim)
+	return lexText
+}
+
+// Emits the contents of a raw section as text, without looking for Braai tags
+// within it
+func lexRaw(l *lexer) stateFn {
+	l.pos += len(l.rawOpener())
+	l.ignore()
+	end := strings.Index(l.input[l.pos:], l.rawCloser())
+	if end < 0 {
+		return l.errorf("Unterminated raw section, should end with %s", l.rawCloser())
+	}
+	l.pos += end
+	l.emit(itemText)
+	l.pos += len(l.rawCloser())
+	l.ignore()
+	return lexText
+}
+
 func lexLeftMeta(l *lexer) stateFn {
-	l.pos += len("{{")
+	if strings.HasPrefix(l.input[l.pos:], l.leftDelim+"!") {
+		return lexComment
+	}
+	l.pos += len(l.leftDelim)
+	if strings.HasPrefix(l.input[l.pos:], trimMarker) {
+		l.pos += len(trimMarker)
+	}
 	if tok := l.next(); tok == '/' {
 		l.emit(itemCloser)
 	} else if tok == eof {
@@ -175,13 +275,26 @@ func lexLeftMeta(l *lexer) stateFn {
 	return lexInsideAction
 }
 
-func lexRightMeta(l *lexer) stateFn {
-	if l.accept("}}") {
-		l.emit(itemRightMeta)
-		return lexText
-	} else {
-		return l.errorf("Malformed end of Braai tag, should be }}")
+// Emits the contents of a comment tag, such as {{! note }}, as a single item.
+// Comments may span multiple lines.
+func lexComment(l *lexer) stateFn {
+	l.pos += len(l.leftDelim + "!")
+	l.ignore()
+	end := strings.Index(l.input[l.pos:], l.rightDelim)
+	if end < 0 {
+		return l.errorf("Unterminated comment")
 	}
+	l.pos += end
+	l.emit(itemComment)
+	l.pos += len(l.rightDelim)
+	l.ignore()
+	return lexText
+}
+
+func lexRightMeta(l *lexer) stateFn {
+	l.pos += len(l.rightDelim)
+	l.emit(itemRightMeta)
+	return lexText
 }
 
 // Braai ignores all whitespace within braai tags
@@ -194,6 +307,15 @@ func lexSpace(l *lexer) stateFn {
 }
 
 func lexInsideAction(l *lexer) stateFn {
+	if strings.HasPrefix(l.input[l.pos:], l.rightDelim) {
+		l.spaceAlreadyScanned = false
+		return lexRightMeta
+	}
+	if strings.HasPrefix(l.input[l.pos:], trimMarker+l.rightDelim) {
+		l.spaceAlreadyScanned = false
+		l.pos += len(trimMarker)
+		return lexRightMeta
+	}
 	switch r := l.next(); {
 	case unicode.IsLetter(r):
 		l.spaceAlreadyScanned = false
@@ -210,9 +332,9 @@ func lexInsideAction(l *lexer) stateFn {
 		} else {
 			return l.errorf("Space already scanned - Lexer defect")
 		}
-	case r == '}':
+	case strings.HasPrefix(l.rightDelim, string(r)):
 		l.spaceAlreadyScanned = false
-		return lexRightMeta
+		return l.errorf("Malformed end of Braai tag, should be %s", l.rightDelim)
 	case r == '.':
 		l.spaceAlreadyScanned = false
 		return lexDotCommand
@@ -257,7 +379,7 @@ func lexBoolean(l *lexer) stateFn {
 		if boolean := l.input[l.start:l.pos]; boolean == "true" {
 			l.emit(itemQuotedArgument)
 		} else {
-			l.errorf("Expected boolean true, saw %s", boolean)
+			return l.errorf("Expected boolean true, saw %s", boolean)
 		}
 	} else if l.accept("f") {
 		for i := 0; i < 4; i++ {
@@ -266,7 +388,7 @@ func lexBoolean(l *lexer) stateFn {
 		if boolean := l.input[l.start:l.pos]; boolean == "false" {
 			l.emit(itemQuotedArgument)
 		} else {
-			l.errorf("Expected boolean false, saw %s", boolean)
+			return l.errorf("Expected boolean false, saw %s", boolean)
 		}
 	}
 
@@ -263,6 +263,74 @@ var lexTests = []lexTest{
 		{itemQuotedArgument, 0, "foo"},
 		{itemRightMeta, 0, "}}"},
 	}},
+	{"escaped left meta", `Write \{{product.name}} to show a name`, []item{
+		{itemText, 0, "Write "},
+		{itemText, 0, "{{product.name}} to show a name"},
+		{itemEOF, 0, ""},
+	}},
+	{"escaped left meta at the beginning", `\{{foo}} and {{bar}}`, []item{
+		{itemText, 0, "{{foo}} and "},
+		{itemLeftMeta, 0, "{{"},
+		{itemIdentifier, 0, "bar"},
+		{itemRightMeta, 0, "}}"},
+		{itemEOF, 0, ""},
+	}},
+	{"multiple escaped left metas", `\{{a}}\{{b}}`, []item{
+		{itemText, 0, "{{a}}"},
+		{itemText, 0, "{{b}}"},
+		{itemEOF, 0, ""},
+	}},
+	{"raw section", `Some JSON: {{{{raw}}}}{"a": {{"b": 1}}}{{{{/raw}}}} and {{foo}}`, []item{
+		{itemText, 0, "Some JSON: "},
+		{itemText, 0, `{"a": {{"b": 1}}}`},
+		{itemText, 0, " and "},
+		{itemLeftMeta, 0, "{{"},
+		{itemIdentifier, 0, "foo"},
+		{itemRightMeta, 0, "}}"},
+		{itemEOF, 0, ""},
+	}},
+	{"unterminated raw section", `Some JSON: {{{{raw}}}}{"a": 1}`, []item{
+		{itemText, 0, "Some JSON: "},
+		{itemError, 0, "Unterminated raw section, should end with {{{{/raw}}}}"},
+	}},
+	{"comment", "Text {{! a note for editors }} more text", []item{
+		{itemText, 0, "Text "},
+		{itemComment, 0, " a note for editors "},
+		{itemText, 0, " more text"},
+		{itemEOF, 0, ""},
+	}},
+	{"multi-line comment", "{{! first line\nsecond line }}{{foo}}", []item{
+		{itemText, 0, ""},
+		{itemComment, 0, " first line\nsecond line "},
+		{itemText, 0, ""},
+		{itemLeftMeta, 0, "{{"},
+		{itemIdentifier, 0, "foo"},
+		{itemRightMeta, 0, "}}"},
+	}},
+	{"unterminated comment", "Text {{! a note", []item{
+		{itemText, 0, "Text "},
+		{itemError, 0, "Unterminated comment"},
+	}},
+	{"trim markers", "Text  {{- product.name -}}  more", []item{
+		{itemText, 0, "Text  "},
+		{itemLeftMeta, 0, "{{-"},
+		{itemIdentifier, 0, "product"},
+		{itemDotCommand, 0, "name"},
+		{itemRightMeta, 0, "-}}"},
+		{itemText, 0, "  more"},
+		{itemEOF, 0, ""},
+	}},
+	{"trim markers on block tags", "{{-callout-}}\n{{-/callout-}}", []item{
+		{itemText, 0, ""},
+		{itemLeftMeta, 0, "{{-"},
+		{itemBlock, 0, "callout"},
+		{itemRightMeta, 0, "-}}"},
+		{itemText, 0, "\n"},
+		{itemCloser, 0, "{{-/"},
+		{itemBlock, 0, "callout"},
+		{itemRightMeta, 0, "-}}"},
+		{itemEOF, 0, ""},
+	}},
 }
 
 // Lexes the document in the test and returns a slice of items
@@ -300,3 +368,78 @@ func TestLexing(t *testing.T) {
 		}
 	}
 }
+
+var delimTests = []lexTest{
+	{"square brackets", "The [[product.name]] and {{not a tag}}", []item{
+		{itemText, 0, "The "},
+		{itemLeftMeta, 0, "[["},
+		{itemIdentifier, 0, "product"},
+		{itemDotCommand, 0, "name"},
+		{itemRightMeta, 0, "]]"},
+		{itemText, 0, " and {{not a tag}}"},
+		{itemEOF, 0, ""},
+	}},
+	{"square brackets with bracketed arguments", "[[callout]][[article.attachments['Photo']]][[/callout]]", []item{
+		{itemText, 0, ""},
+		{itemLeftMeta, 0, "[["},
+		{itemBlock, 0, "callout"},
+		{itemRightMeta, 0, "]]"},
+		{itemText, 0, ""},
+		{itemLeftMeta, 0, "[["},
+		{itemIdentifier, 0, "article"},
+		{itemDotCommand, 0, "attachments"},
+		{itemBracketedArgument, 0, "Photo"},
+		{itemRightMeta, 0, "]]"},
+		{itemText, 0, ""},
+		{itemCloser, 0, "[[/"},
+		{itemBlock, 0, "callout"},
+		{itemRightMeta, 0, "]]"},
+	}},
+	{"erb style", `<% youtube "1234" %> <%! a comment %>\<% literal %>`, []item{
+		{itemText, 0, ""},
+		{itemLeftMeta, 0, "<%"},
+		{itemIdentifier, 0, "youtube"},
+		{itemQuotedArgument, 0, "1234"},
+		{itemRightMeta, 0, "%>"},
+		{itemText, 0, " "},
+		{itemComment, 0, " a comment "},
+		{itemText, 0, "<% literal %>"},
+		{itemEOF, 0, ""},
+	}},
+	{"malformed end with custom delimiters", "<% youtube '1234' % ", []item{
+		{itemText, 0, ""},
+		{itemLeftMeta, 0, "<%"},
+		{itemIdentifier, 0, "youtube"},
+		{itemQuotedArgument, 0, "1234"},
+		{itemError, 0, "Malformed end of Braai tag, should be %>"},
+	}},
+	{"raw section with custom delimiters", "[[[[raw]]]][[foo]][[[[/raw]]]]", []item{
+		{itemText, 0, "[[foo]]"},
+		{itemEOF, 0, ""},
+	}},
+}
+
+func TestLexingDelims(t *testing.T) {
+	for _, test := range delimTests {
+		lexer := NewLexer(test.input, []string{"callout"})
+		if test.input[0] == '<' {
+			lexer.delims("<%", "%>")
+		} else {
+			lexer.delims("[[", "]]")
+		}
+
+		for idx, expected := range test.items {
+			actual := lexer.NextToken()
+			if actual.Type == itemError && expected.Type != itemError {
+				t.Errorf("%s:\n\tLexical Error: %s. Location: %d", test.name, actual.Value, actual.Pos)
+				break
+			}
+			if expected.Value != actual.Value {
+				t.Errorf("%s:\n\tItem %d: Expected \"%s\" to equal \"%s\"", test.name, idx, actual.Value, expected.Value)
+			}
+			if expected.Type != actual.Type {
+				t.Errorf("%s:\n\tItem %d: Expected \"%s\" to equal \"%s\"", test.name, idx, actual.Type, expected.Type)
+			}
+		}
+	}
+}
@@ -1,18 +1,33 @@
 package parse
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"strings"
+	"io"
 )
 
 // A Node represents any struct which is able to traverse itself (and any of
 // its children, if applicable) with the passed in HandlerMux. It signifies a
-// Node in a Braai AST.
+// Node in a Braai AST. ExecuteTo writes the output of the Node to a Writer as
+// it is produced, while Execute collects it into a string. The Context
+// variants pass ctx along to any handlers which accept one, and abandon
+// execution once ctx is cancelled.
 type Node interface {
 	Execute(*HandlerMux) (string, error)
+	ExecuteTo(io.Writer, *HandlerMux) error
+	ExecuteContext(context.Context, *HandlerMux) (string, error)
+	ExecuteToContext(context.Context, io.Writer, *HandlerMux) error
 	Visit(Visitor)
 }
 
+// execute collects the output of node's ExecuteToContext method into a string
+func execute(ctx context.Context, node Node, mux *HandlerMux) (string, error) {
+	var buf bytes.Buffer
+	err := node.ExecuteToContext(ctx, &buf, mux)
+	return buf.String(), err
+}
+
 // A Visitor implements the Visitor pattern for Brush ASTs. When passed to the
 // Visit method of a Node, the Visitor's methods will be called on the Nodes of
 // the AST in depth-first traversal order. The method invoked will depend on
@@ -23,29 +38,55 @@ type Visitor interface {
 	AcceptTextNode(*TextNode)
 }
 
+// A CommentVisitor is a Visitor which is also interested in the comments
+// within a Brush AST. Comments are only presented to Visitors implementing
+// this interface.
+type CommentVisitor interface {
+	Visitor
+	AcceptComment(*CommentNode)
+}
+
 // A DocumentNode represents a complete Braai document. There are no
 // restrictions as to where these can appear in the document to support things
 // such as including other documents and also representing the Subtrees of a
 // BlockTagNode
 type DocumentNode struct {
 	NodeList []Node
+	Pos      Position
+	Source   *Source // the source of the node, when parsed in lossless mode
 }
 
 // Execute implements the Node interface, and invokes Execute on every member
 // of the  DocumentNode's NodeList, assembling each fragment into a whole to be
 // returned to the caller
-func (d *DocumentNode) Execute(mux *HandlerMux) (str string, err error) {
-	parts := make([]string, 0, len(d.NodeList))
+func (d *DocumentNode) Execute(mux *HandlerMux) (string, error) {
+	return execute(context.Background(), d, mux)
+}
+
+// ExecuteContext is like Execute, but passes ctx to every member of the
+// NodeList
+func (d *DocumentNode) ExecuteContext(ctx context.Context, mux *HandlerMux) (string, error) {
+	return execute(ctx, d, mux)
+}
+
+// ExecuteTo invokes ExecuteTo on every member of the DocumentNode's NodeList
+// in order, stopping at the first error
+func (d *DocumentNode) ExecuteTo(w io.Writer, mux *HandlerMux) error {
+	return d.ExecuteToContext(context.Background(), w, mux)
+}
+
+// ExecuteToContext is like ExecuteTo, but passes ctx to every member of the
+// NodeList. Execution stops with the error of ctx as soon as it is cancelled.
+func (d *DocumentNode) ExecuteToContext(ctx context.Context, w io.Writer, mux *HandlerMux) error {
 	for _, node := range d.NodeList {
-		str, err = node.Execute(mux)
-		if err == nil {
-			parts = append(parts, str)
-		} else {
-			break
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := node.ExecuteToContext(ctx, w, mux); err != nil {
+			return err
 		}
 	}
-
-	return strings.Join(parts, ""), err
+	return nil
 }
 
 // Visit implements the Visitor interface for DocumentNodes. It has no
@@ -62,18 +103,53 @@ func (d *DocumentNode) Visit(v Visitor) {
 type BlockTagNode struct {
 	Name    string
 	Subtree Node
+	Pos     Position // spans from the opener through the closer
+	Source  *Source  // the source of the node, when parsed in lossless mode
 }
 
 // Execute searches for a registered block tag handler within the HandlerMux,
 // invoking it if present. It is expected that this handler will compile the
 // Subtree, but it is not required
 func (b *BlockTagNode) Execute(mux *HandlerMux) (string, error) {
+	return b.ExecuteContext(context.Background(), mux)
+}
+
+// ExecuteContext is like Execute, but prefers a BlockContextHandlerFunc
+// registered for this BlockTag, passing it ctx
+func (b *BlockTagNode) ExecuteContext(ctx context.Context, mux *HandlerMux) (string, error) {
+	if mux.GetBlockStream(b.Name) != nil {
+		return execute(ctx, b, mux)
+	}
+	if handler := mux.GetBlockContext(b.Name); handler != nil {
+		str, err := handler(ctx, b)
+		return str, handlerError(b.Pos, b.Name, err)
+	}
 	handler := mux.GetBlock(b.Name)
 	if handler != nil {
-		return handler(b)
+		str, err := handler(b)
+		return str, handlerError(b.Pos, b.Name, err)
 	} else {
-		return "", fmt.Errorf("Block Handler not defined for tag: %s", b.Name)
+		return "", &UndefinedHandlerError{Pos: b.Pos, Tag: b.Name, Block: true}
+	}
+}
+
+// ExecuteTo invokes the block stream handler registered for this BlockTag,
+// falling back to its block handler and writing the result
+func (b *BlockTagNode) ExecuteTo(w io.Writer, mux *HandlerMux) error {
+	return b.ExecuteToContext(context.Background(), w, mux)
+}
+
+// ExecuteToContext is like ExecuteTo, but passes ctx to the handler
+func (b *BlockTagNode) ExecuteToContext(ctx context.Context, w io.Writer, mux *HandlerMux) error {
+	if stream := mux.GetBlockStream(b.Name); stream != nil {
+		return handlerError(b.Pos, b.Name, stream(ctx, w, b))
 	}
+	str, err := b.ExecuteContext(ctx, mux)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, str)
+	return err
 }
 
 // Visit implements the Visitor interface for BlockTags. Visit is first invoked
@@ -87,7 +163,9 @@ func (b *BlockTagNode) Visit(v Visitor) {
 // A TextNode represents text devoid of any Braai tags. These are left
 // unmodified by handlers.
 type TextNode struct {
-	Text []byte
+	Text   []byte
+	Pos    Position
+	Source *Source // the source of the node, when parsed in lossless mode
 }
 
 // Execute passes the TextNode's Text  back to the caller
@@ -95,41 +173,205 @@ func (t *TextNode) Execute(mux *HandlerMux) (string, error) {
 	return string(t.Text), nil
 }
 
+// ExecuteTo writes the TextNode's Text unmodified
+func (t *TextNode) ExecuteTo(w io.Writer, mux *HandlerMux) error {
+	_, err := w.Write(t.Text)
+	return err
+}
+
+// ExecuteContext is equivalent to Execute, since text has no handler
+func (t *TextNode) ExecuteContext(ctx context.Context, mux *HandlerMux) (string, error) {
+	return t.Execute(mux)
+}
+
+// ExecuteToContext is equivalent to ExecuteTo, since text has no handler
+func (t *TextNode) ExecuteToContext(ctx context.Context, w io.Writer, mux *HandlerMux) error {
+	return t.ExecuteTo(w, mux)
+}
+
 // Visit invokes the AcceptTextNode method of the Visitor, passing this
 // TextNode in accordance with the Visitor pattern
 func (t *TextNode) Visit(v Visitor) {
 	v.AcceptTextNode(t)
 }
 
+// A CommentNode represents a comment tag, such as:
+//   {{! a note for other editors }}
+// Comments are retained in the AST for tooling, but produce no output.
+type CommentNode struct {
+	Text   string
+	Pos    Position
+	Source *Source // the source of the node, when parsed in lossless mode
+}
+
+// Execute renders nothing, as comments are not part of the output
+func (c *CommentNode) Execute(mux *HandlerMux) (string, error) {
+	return "", nil
+}
+
+// ExecuteTo writes nothing, as comments are not part of the output
+func (c *CommentNode) ExecuteTo(w io.Writer, mux *HandlerMux) error {
+	return nil
+}
+
+// ExecuteContext renders nothing, as comments are not part of the output
+func (c *CommentNode) ExecuteContext(ctx context.Context, mux *HandlerMux) (string, error) {
+	return "", nil
+}
+
+// ExecuteToContext writes nothing, as comments are not part of the output
+func (c *CommentNode) ExecuteToContext(ctx context.Context, w io.Writer, mux *HandlerMux) error {
+	return nil
+}
+
+// Visit invokes the AcceptComment method of the Visitor if it implements
+// CommentVisitor. Other Visitors are unaffected by comments.
+func (c *CommentNode) Visit(v Visitor) {
+	if cv, ok := v.(CommentVisitor); ok {
+		cv.AcceptComment(c)
+	}
+}
+
+// An ErrorNode represents a malformed region of a document which was skipped
+// by a recovering Tree. Err describes the problem encountered there.
+type ErrorNode struct {
+	Err    error
+	Pos    Position
+	Source *Source // the source of the node, when parsed in lossless mode
+}
+
+// Execute renders the placeholder registered with the HandlerMux using
+// ErrorPlaceholder, or nothing if there is none
+func (e *ErrorNode) Execute(mux *HandlerMux) (string, error) {
+	if mux.errorPlaceholder == nil {
+		return "", nil
+	}
+	return mux.errorPlaceholder(e), nil
+}
+
+// ExecuteTo writes the placeholder registered with the HandlerMux using
+// ErrorPlaceholder, if any
+func (e *ErrorNode) ExecuteTo(w io.Writer, mux *HandlerMux) error {
+	if mux.errorPlaceholder == nil {
+		return nil
+	}
+	_, err := io.WriteString(w, mux.errorPlaceholder(e))
+	return err
+}
+
+// ExecuteContext is equivalent to Execute
+func (e *ErrorNode) ExecuteContext(ctx context.Context, mux *HandlerMux) (string, error) {
+	return e.Execute(mux)
+}
+
+// ExecuteToContext is equivalent to ExecuteTo
+func (e *ErrorNode) ExecuteToContext(ctx context.Context, w io.Writer, mux *HandlerMux) error {
+	return e.ExecuteTo(w, mux)
+}
+
+// Visit is a no-op, since ErrorNodes have no corresponding Accept method
+func (e *ErrorNode) Visit(v Visitor) {
+	// NOP
+}
+
+// An ErrorList collects the errors encountered by a recovering Tree, in the
+// order they appear in the document
+type ErrorList []error
+
+// Error reports the first error in the list, along with how many others
+// followed it
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	default:
+		return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
+	}
+}
+
 // A BraaiTagNode represents a non-block Braai tag. All DotCommands, Arguments,
-// and Attributes for the tag are also stored here
+// and Attributes for the tag are also stored here. ArgumentNodes holds the
+// Arguments along with their Positions, and AttributePos holds the Position of
+// every attribute, spanning both its name and value.
 type BraaiTagNode struct {
-	Text        string
-	DotCommands []DotCommandNode
-	Arguments   []string
-	Attributes  map[string]string
-	Pos         string
+	Text            string
+	DotCommands     []DotCommandNode
+	Arguments       []string
+	Attributes      map[string]string
+	Pos             Position
+	ArgumentNodes   []*SingleArgumentNode
+	AttributePos    map[string]Position
+	Escaping        Escaping // the escaping required where the tag appears, see AnalyzeEscaping
+	CommandArgument bool     // whether Arguments[0] follows the command itself, as in {{product(42)}}
+	Source          *Source  // the source of the node, when parsed in lossless mode
 }
 
 // Execute searches for a HandlerFunc for this BraaiTag and invokes it if
 // found.
 func (b *BraaiTagNode) Execute(mux *HandlerMux) (string, error) {
+	return b.ExecuteContext(context.Background(), mux)
+}
+
+// ExecuteContext is like Execute, but prefers a ContextHandlerFunc registered
+// for this BraaiTag, passing it ctx
+func (b *BraaiTagNode) ExecuteContext(ctx context.Context, mux *HandlerMux) (string, error) {
+	if mux.GetStream(b.Text) != nil {
+		return execute(ctx, b, mux)
+	}
+	b = mux.withDefaults(b)
+	if handler := mux.GetContext(b.Text); handler != nil {
+		str, err := handler(ctx, b)
+		return mux.escapeTag(b, str), handlerError(b.Pos, b.Text, err)
+	}
 	handler := mux.Get(b.Text)
-	if handler != nil {
-		return handler(b)
-	} else {
+	if handler == nil {
 		handler = mux.GetDefaultHandler()
-		if handler != nil {
-			return handler(b)
-		} else {
-			return "", b.Errorf("Handler not defined for tag: %s", b.Text)
-		}
 	}
+	if handler == nil {
+		return "", &UndefinedHandlerError{Pos: b.Pos, Tag: b.Text}
+	}
+	str, err := handler(b)
+	return mux.escapeOutput(b, str), handlerError(b.Pos, b.Text, err)
+}
+
+// ExecuteTo invokes the StreamHandlerFunc registered for this BraaiTag,
+// falling back to its HandlerFunc and writing the result
+func (b *BraaiTagNode) ExecuteTo(w io.Writer, mux *HandlerMux) error {
+	return b.ExecuteToContext(context.Background(), w, mux)
+}
+
+// ExecuteToContext is like ExecuteTo, but passes ctx to the handler
+func (b *BraaiTagNode) ExecuteToContext(ctx context.Context, w io.Writer, mux *HandlerMux) error {
+	if stream := mux.GetStream(b.Text); stream != nil {
+		return handlerError(b.Pos, b.Text, stream(ctx, w, mux.withDefaults(b)))
+	}
+	str, err := b.ExecuteContext(ctx, mux)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, str)
+	return err
 }
 
+// Errorf returns a HandlerError positioned at this BraaiTag, for use by
+// handlers
 func (b *BraaiTagNode) Errorf(format string, args ...interface{}) error {
-	format = b.Pos + "Exec error - " + format
-	return fmt.Errorf(format, args)
+	return &HandlerError{Pos: b.Pos, Tag: b.Text, Err: fmt.Errorf(format, args...)}
+}
+
+// bindError reports a failure to bind the arguments of this BraaiTag to the
+// parameters of a reflected handler, positioned at the argument or attribute
+// responsible
+func (b *BraaiTagNode) bindError(pos Position, format string, args ...interface{}) error {
+	return &HandlerError{Pos: pos, Tag: b.Text, Err: fmt.Errorf(format, args...)}
+}
+
+// addArgument appends a positional argument to the BraaiTag
+func (b *BraaiTagNode) addArgument(arg *SingleArgumentNode) {
+	b.Arguments = append(b.Arguments, arg.Text)
+	b.ArgumentNodes = append(b.ArgumentNodes, arg)
 }
 
 // Visit presents this BraaiTag to the Visitor by way of its AcceptTag method,
@@ -142,6 +384,7 @@ func (b *BraaiTagNode) Visit(v Visitor) {
 // following a top level command or one following a dot command.
 type SingleArgumentNode struct {
 	Text string
+	Pos  Position // spans any surrounding parentheses, brackets or quotes
 }
 
 // Execute returns the text of the argument. It is assumed that a
@@ -150,6 +393,22 @@ func (t *SingleArgumentNode) Execute(mux *HandlerMux) (string, error) {
 	return t.Text, nil
 }
 
+// ExecuteTo writes the text of the argument
+func (t *SingleArgumentNode) ExecuteTo(w io.Writer, mux *HandlerMux) error {
+	_, err := io.WriteString(w, t.Text)
+	return err
+}
+
+// ExecuteContext returns the text of the argument
+func (t *SingleArgumentNode) ExecuteContext(ctx context.Context, mux *HandlerMux) (string, error) {
+	return t.Text, nil
+}
+
+// ExecuteToContext writes the text of the argument
+func (t *SingleArgumentNode) ExecuteToContext(ctx context.Context, w io.Writer, mux *HandlerMux) error {
+	return t.ExecuteTo(w, mux)
+}
+
 func (t *SingleArgumentNode) Visit(v Visitor) {
 	// NOP
 }
@@ -162,6 +421,7 @@ func (t *SingleArgumentNode) Visit(v Visitor) {
 type DotCommandNode struct {
 	Text     string
 	Argument Node
+	Pos      Position // spans from the dot through the argument
 }
 
 // Execute is effectively a no-op here, since it is assumed to be handled by
@@ -169,3 +429,25 @@ type DotCommandNode struct {
 func (d *DotCommandNode) Execute(mux *HandlerMux) (string, error) {
 	return "", nil
 }
+
+// ExecuteTo writes nothing, as dot commands are handled by the BraaiTag
+// handler
+func (d *DotCommandNode) ExecuteTo(w io.Writer, mux *HandlerMux) error {
+	return nil
+}
+
+// ExecuteContext is equivalent to Execute
+func (d *DotCommandNode) ExecuteContext(ctx context.Context, mux *HandlerMux) (string, error) {
+	return d.Execute(mux)
+}
+
+// ExecuteToContext is equivalent to ExecuteTo
+func (d *DotCommandNode) ExecuteToContext(ctx context.Context, w io.Writer, mux *HandlerMux) error {
+	return d.ExecuteTo(w, mux)
+}
+
+// Visit is a no-op, since Visitors have no method for dot commands. Use Walk
+// to reach them.
+func (d *DotCommandNode) Visit(v Visitor) {
+	// NOP
+}
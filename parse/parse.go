@@ -1,36 +1,51 @@
 package parse
 
+import "bytes"
 import "fmt"
-import "strconv"
+import "runtime"
+import "strings"
+import "unicode"
 
 // A Tree holds all of the parsing state necessary to transform a document into
 // an AST
 type Tree struct {
-	lexer      *lexer // the lexer which is the source of tokens
-	Error      error  // the last returned error
-	ParseName  string // the name of the document being parsed
-	token      item   // maintains one token lookahead
-	peekCount  int    // count of how many tokens of lookahead we have
-	lastCol    int    // column of the last item in the lookahead buffer
-	blockLevel int    // nesting level of block tags
-}
-
-func (t *Tree) formatPos() string {
-	if t.peekCount == 0 {
-		return t.ParseName + ":" + strconv.Itoa(t.lexer.lineNumber()) + ":" + strconv.Itoa(t.lexer.column()) + ": "
-	} else {
-		return t.ParseName + ":" + strconv.Itoa(t.lexer.lineNumber()) + ":" + strconv.Itoa(t.lastCol) + ": "
-	}
+	lexer      *lexer     // the lexer which is the source of tokens
+	Error      error      // the last returned error
+	ParseName  string     // the name of the document being parsed
+	token      item       // maintains one token lookahead
+	peekCount  int        // count of how many tokens of lookahead we have
+	blockLevel int        // nesting level of block tags
+	trimNext   bool       // whether leading whitespace should be trimmed from the next text
+	lines      *lineIndex // converts offsets into Positions
+	recovering bool       // whether parsing continues after errors
+	lossless   bool       // whether nodes retain their source
+	Errors     ErrorList  // every error encountered while recovering
+}
+
+// pos returns the Position of the span of the document between start and end
+func (t *Tree) pos(start, end int) Position {
+	return t.lines.position(t.ParseName, start, end)
 }
 
 // Parse creates an AST from the document that the parser was initialized with.
+// If the Tree is recovering, the AST is returned even when errors were
+// encountered, and the error returned is the ErrorList of every one of them.
 func (t *Tree) Parse() (root Node, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = r.(error)
 		}
 	}()
-	root = t.document()
+	root = t.document(0)
+	if t.lossless {
+		t.retainSource(root.(*DocumentNode), nil, nil)
+	}
+	if t.recovering {
+		if len(t.Errors) > 0 {
+			return root, t.Errors
+		}
+		return root, nil
+	}
 	if t.Error != nil {
 		return nil, t.Error
 	} else {
@@ -39,125 +54,212 @@ func (t *Tree) Parse() (root Node, err error) {
 }
 
 // DOCUMENT -> itemText DOCUMENT
+//           | itemComment DOCUMENT
 //           | BRAAI DOCUMENT
 //           | ε
-func (t *Tree) document() Node {
+func (t *Tree) document(start int) Node {
 	root := &DocumentNode{}
 	root.NodeList = make([]Node, 0)
+	end := start
+	defer func() {
+		root.Pos = t.pos(start, end)
+	}()
 	for {
-		tok := t.lexer.NextToken()
+		tok := t.next()
+		end = tok.Pos
 		switch tok.Type {
 		case itemText:
-			root.NodeList = append(root.NodeList, &TextNode{[]byte(tok.Value)})
+			text := &TextNode{Text: []byte(tok.Value), Pos: t.pos(tok.Pos, tok.Pos+len(tok.Value))}
+			if t.trimNext {
+				t.trimLeft(text)
+				t.trimNext = false
+			}
+			root.NodeList = append(root.NodeList, text)
+		case itemComment:
+			opener := len(t.lexer.leftDelim + "!")
+			pos := t.pos(tok.Pos-opener, tok.Pos+len(tok.Value)+len(t.lexer.rightDelim))
+			root.NodeList = append(root.NodeList, &CommentNode{Text: strings.TrimSpace(tok.Value), Pos: pos})
 		case itemEOF:
 			return root
 		case itemError:
-			t.Error = fmt.Errorf(tok.Value)
+			t.Error = t.lexicalError(tok)
+			if t.recovering {
+				root.NodeList = append(root.NodeList, t.errorNode(tok, t.Error))
+				continue
+			}
 			return root
 		case itemCloser:
+			t.trimBefore(root, tok)
 			if t.blockLevel > 0 {
 				return root
 			} else {
-				t.Error = fmt.Errorf("Unexpected closing tag at at %d", tok.Pos)
+				t.Error = t.syntaxError(tok, "Unexpected closing tag")
+				if t.recovering {
+					root.NodeList = append(root.NodeList, t.errorNode(tok, t.Error))
+				}
 			}
 		case itemLeftMeta:
-			root.NodeList = append(root.NodeList, t.blockOrRegular())
+			t.trimBefore(root, tok)
+			root.NodeList = append(root.NodeList, t.tag(tok))
 			if t.Error != nil {
 				return root
 			}
 		default:
-			t.Error = fmt.Errorf("Unexpected token %s at %d", tok.Type, tok.Pos)
+			t.Error = t.syntaxError(tok, "Unexpected %s", describe(tok))
 			return root
 		}
 	}
-	return root
+}
+
+// tag parses the braai tag beginning with opener. If the Tree is recovering,
+// any error encountered is recorded and the tag is replaced by an ErrorNode.
+func (t *Tree) tag(opener item) (node Node) {
+	if !t.recovering {
+		return t.blockOrRegular(opener)
+	}
+	blockLevel := t.blockLevel
+	defer func() {
+		if r := recover(); r != nil {
+			err, ok := r.(error)
+			if _, isRuntime := r.(runtime.Error); !ok || isRuntime {
+				panic(r)
+			}
+			t.blockLevel = blockLevel
+			node = t.errorNode(opener, err)
+		}
+	}()
+	node = t.blockOrRegular(opener)
+	if t.Error != nil {
+		node = t.errorNode(opener, t.Error)
+	}
+	return node
+}
+
+// errorNode records err and discards tokens until the parser is
+// resynchronized, returning an ErrorNode spanning from opener to the point of
+// resynchronization
+func (t *Tree) errorNode(opener item, err error) *ErrorNode {
+	end := t.synchronize()
+	if end < opener.Pos {
+		end = opener.Pos
+	}
+	node := &ErrorNode{Err: err, Pos: t.pos(opener.Pos, end)}
+	t.Errors = append(t.Errors, err)
+	t.Error = nil
+	return node
+}
+
+// synchronize discards tokens up to and including the next right meta, or up
+// to the next token which may begin a new node, returning the offset at which
+// parsing resumes. A lexical error found along the way belongs to the same
+// malformed region, so it is discarded too; the lexer has already skipped the
+// remainder of the tag.
+func (t *Tree) synchronize() int {
+	for {
+		tok := t.next()
+		switch tok.Type {
+		case itemRightMeta:
+			return tok.Pos + len(tok.Value)
+		case itemText, itemComment, itemLeftMeta, itemCloser, itemEOF:
+			t.backup()
+			return tok.Pos
+		}
+	}
 }
 
 // BLOCK_OR_REGULAR -> itemBlock itemRightMeta DOCUMENT itemCloser itemBlock itemRightMeta
 //                    | REGULAR
-func (t *Tree) blockOrRegular() Node {
+func (t *Tree) blockOrRegular(opener item) Node {
 	tok := t.expectOneOf(itemIdentifier, itemBlock)
 	if tok.Type == itemIdentifier {
 		t.backup()
-		return t.braaiTag()
+		return t.braaiTag(opener)
 	} else if tok.Type == itemBlock {
 		t.backup()
-		return t.blockTag()
-	} else if tok.Type == itemError {
-		t.Error = fmt.Errorf("Lexical Error while parsing BLOCK_OR_REGULAR: %s", tok.Value)
-		return &BraaiTagNode{}
+		return t.blockTag(opener)
 	} else {
-		t.Error = fmt.Errorf("Unexpected token %s at %d", tok.Type, tok.Pos)
+		// expectOneOf has already reported the error
 		return &BraaiTagNode{}
 	}
 }
 
 // REGULAR -> itemIdent DOTCOMMANDS ARG_LIST MODIFIERS itemRightMeta
-func (t *Tree) braaiTag() Node {
-	posFormat := t.formatPos()
-	ident := t.expect(itemIdentifier, "braai tag")
+func (t *Tree) braaiTag(opener item) Node {
+	tag := &BraaiTagNode{
+		Arguments:    make([]string, 0),
+		Attributes:   make(map[string]string),
+		AttributePos: make(map[string]Position),
+	}
+	tag.Text = t.expect(itemIdentifier, "braai tag").Value
 	tok := t.next()
-	var arguments []string = make([]string, 0)
 	switch tok.Type {
 	case itemParenthesizedArgument, itemBracketedArgument:
-		arguments = append(arguments, tok.Value)
+		tag.addArgument(t.argument(tok))
+		tag.CommandArgument = true
 	default:
 		t.backup()
 	}
-	dotCommands := t.dotCommands()
+	tag.DotCommands = t.dotCommands()
 	for _, arg := range t.argumentList() {
-		arguments = append(arguments, arg)
+		tag.addArgument(arg)
 	}
-	attrs := t.attributes()
-	t.expect(itemRightMeta, "braai tag")
-	return &BraaiTagNode{ident.Value, dotCommands, arguments, attrs, posFormat}
+	t.attributes(tag)
+	closer := t.expect(itemRightMeta, "braai tag")
+	t.trimAfter(closer)
+	tag.Pos = t.pos(opener.Pos, closer.Pos+len(closer.Value))
+	return tag
 }
 
-func (t *Tree) argumentList() (arguments []string) {
+func (t *Tree) argumentList() (arguments []*SingleArgumentNode) {
 	for {
 		tok := t.next()
 		if tok.Type != itemQuotedArgument {
 			t.backup()
 			break
 		}
-		arguments = append(arguments, tok.Value)
+		arguments = append(arguments, t.argument(tok))
 	}
 	return
 }
 
-func (t *Tree) attributes() map[string]string {
+func (t *Tree) attributes(tag *BraaiTagNode) {
 	const context string = "attribute list"
-	attrs := make(map[string]string)
 	for {
 		if t.next().Type == itemRightMeta {
 			t.backup()
-			return attrs
+			return
 		}
 		t.backup()
 		key := t.expect(itemIdentifier, context)
 		t.expect(itemAssign, context)
-		value := t.expect(itemQuotedArgument, context)
+		value := t.argument(t.expect(itemQuotedArgument, context))
 		if t.Error != nil {
-			return attrs
+			return
 		}
-		attrs[key.Value] = value.Value
+		tag.Attributes[key.Value] = value.Text
+		tag.AttributePos[key.Value] = t.pos(key.Pos, value.Pos.End)
 	}
-	return attrs
 }
 
-func (t *Tree) blockTag() Node {
+func (t *Tree) blockTag(opener item) Node {
 	const context string = "block tag"
 	tok := t.expect(itemBlock, context)
-	t.expect(itemRightMeta, context)
+	openerEnd := t.expect(itemRightMeta, context)
+	t.trimAfter(openerEnd)
 	t.blockLevel++
-	body := t.document()
+	body := t.document(openerEnd.Pos + len(openerEnd.Value))
+	if t.Error != nil {
+		// the body ended at the error, rather than at the closer
+		panic(t.Error)
+	}
 	end_tok := t.expect(itemBlock, context)
-	t.expect(itemRightMeta, context)
+	closer := t.expect(itemRightMeta, context)
+	t.trimAfter(closer)
 	if tok.Value != end_tok.Value {
-		t.Error = fmt.Errorf("Mismatched block tag, opener: %s, closer: %s", tok.Value, end_tok.Value)
+		t.Error = t.syntaxError(end_tok, "Mismatched block tag, opener: %s, closer: %s", tok.Value, end_tok.Value)
 	}
 	t.blockLevel--
-	return &BlockTagNode{tok.Value, body}
+	return &BlockTagNode{Name: tok.Value, Subtree: body, Pos: t.pos(opener.Pos, closer.Pos+len(closer.Value))}
 }
 
 // DOTCOMMANDS -> itemDotCommand SINGLE_ARGS DOTCOMMANDS | ε
@@ -168,32 +270,76 @@ func (t *Tree) dotCommands() (dotCommands []DotCommandNode) {
 			t.backup()
 			break
 		} else {
+			start, end := tok.Pos-len("."), tok.Pos+len(tok.Value)
 			argument := t.singleArgument()
-			dotCommands = append(dotCommands, DotCommandNode{tok.Value, argument})
+			if argument != nil {
+				end = argument.Pos.End
+				dotCommands = append(dotCommands, DotCommandNode{tok.Value, argument, t.pos(start, end)})
+			} else {
+				dotCommands = append(dotCommands, DotCommandNode{tok.Value, nil, t.pos(start, end)})
+			}
 		}
 	}
 	return dotCommands
 }
 
-func (t *Tree) singleArgument() Node {
+func (t *Tree) singleArgument() *SingleArgumentNode {
 	tok := t.next()
 	switch tok.Type {
 	case itemParenthesizedArgument, itemBracketedArgument:
-		return &SingleArgumentNode{tok.Value}
-	case itemDotCommand, itemRightMeta:
-		t.backup()
-		return nil
+		return t.argument(tok)
 	default:
-		t.Error = fmt.Errorf("Unexpected token %s in single argument at %d", tok.Value, tok.Pos)
+		t.backup()
 		return nil
 	}
 }
 
+// argument creates a SingleArgumentNode from tok, whose Position spans any
+// parentheses, brackets or quotes surrounding the value
+func (t *Tree) argument(tok item) *SingleArgumentNode {
+	start, end := tok.Pos, tok.Pos+len(tok.Value)
+	switch tok.Type {
+	case itemParenthesizedArgument:
+		start, end = start-len("("), end+len(")")
+	case itemBracketedArgument:
+		start, end = start-len("['"), end+len("']")
+	case itemQuotedArgument:
+		if start > 0 && strings.IndexByte(`'"`, t.lines.input[start-1]) >= 0 {
+			start, end = start-1, end+1
+		}
+	}
+	return &SingleArgumentNode{tok.Value, t.pos(start, end)}
+}
+
+// trimLeft removes leading whitespace from text, adjusting its Position
+func (t *Tree) trimLeft(text *TextNode) {
+	trimmed := bytes.TrimLeftFunc(text.Text, unicode.IsSpace)
+	text.Pos = t.pos(text.Pos.End-len(trimmed), text.Pos.End)
+	text.Text = trimmed
+}
+
+// trimBefore removes trailing whitespace from the last TextNode of root if the
+// left meta or closer tok carries a trim marker, e.g. {{- or {{-/
+func (t *Tree) trimBefore(root *DocumentNode, tok item) {
+	if !strings.HasPrefix(tok.Value, t.lexer.leftDelim+trimMarker) || len(root.NodeList) == 0 {
+		return
+	}
+	if text, ok := root.NodeList[len(root.NodeList)-1].(*TextNode); ok {
+		text.Text = bytes.TrimRightFunc(text.Text, unicode.IsSpace)
+		text.Pos.End = text.Pos.Offset + len(text.Text)
+	}
+}
+
+// trimAfter arranges for leading whitespace to be removed from the next
+// TextNode if the right meta tok carries a trim marker, e.g. -}}
+func (t *Tree) trimAfter(tok item) {
+	t.trimNext = tok.Value == trimMarker+t.lexer.rightDelim
+}
+
 func (t *Tree) next() item {
 	if t.peekCount > 1 {
 		panic("Parser lookahead overflow")
 	} else if t.peekCount == 0 {
-		t.lastCol = t.lexer.column()
 		t.token = t.lexer.NextToken()
 	} else {
 		t.peekCount--
@@ -205,39 +351,92 @@ func (t *Tree) backup() {
 	t.peekCount++
 }
 
-func (t *Tree) errorf(format string, args ...interface{}) {
-	format = fmt.Sprintf("%s:%d:%d: %s", t.ParseName, t.lexer.lineNumber(), t.lexer.column(), format)
-	panic(fmt.Errorf(format, args...))
+// syntaxError returns a SyntaxError positioned at tok
+func (t *Tree) syntaxError(tok item, format string, args ...interface{}) *SyntaxError {
+	return &SyntaxError{
+		Pos:    t.pos(tok.Pos, tok.Pos+len(tok.Value)),
+		Msg:    fmt.Sprintf(format, args...),
+		Actual: tokenKinds[tok.Type],
+	}
+}
+
+// lexicalError returns a SyntaxError for the itemError tok
+func (t *Tree) lexicalError(tok item) *SyntaxError {
+	return &SyntaxError{Pos: t.pos(tok.Pos, tok.Pos), Msg: tok.Value, Lexical: true}
 }
 
 func (t *Tree) expectOneOf(expected ...itemType) item {
 	tok := t.next()
+	kinds := make([]string, 0, len(expected))
 	for _, expectedTok := range expected {
 		if tok.Type == expectedTok {
 			return tok
 		}
+		kinds = append(kinds, tokenKinds[expectedTok])
+	}
+	if tok.Type == itemError {
+		t.Error = t.lexicalError(tok)
+	} else {
+		t.backup()
+		err := t.syntaxError(tok, "Unexpected %s, expected %s", describe(tok), strings.Join(kinds, " or "))
+		err.Expected = strings.Join(kinds, " or ")
+		t.Error = err
 	}
-	t.backup()
-	t.Error = fmt.Errorf("Unexpected %s at position %d", tok.Value, tok.Pos)
 	return tok
 }
 
+// expect returns the next token, aborting parsing with a SyntaxError if it is
+// not of the expected type. A lexical error is consumed as it is reported, so
+// that recovery resumes after it.
 func (t *Tree) expect(expected itemType, context string) item {
 	tok := t.next()
 	if tok.Type != expected {
-		t.backup()
 		if tok.Type == itemError {
-			t.errorf("Lexical Error - %s", tok.Value)
-		} else {
-			t.errorf("Unexpected %d, expected to see %d", tok.Value, expected)
+			panic(t.lexicalError(tok))
 		}
-		//t.Error = fmt.Errorf("Unexpected %s in %s at position %d. Expected %d, saw %d", tok.Value, context, tok.Pos, expected, tok.Type)
+		t.backup()
+		err := t.syntaxError(tok, "Unexpected %s in %s, expected %s", describe(tok), context, tokenKinds[expected])
+		err.Expected = tokenKinds[expected]
+		panic(err)
 	}
 	return tok
 }
 
+// Recover puts the Tree into recovery mode, returning the Tree so that calls
+// can be chained. When recovering, errors do not stop parsing. Instead, the
+// parser resynchronizes at the end of the malformed tag, or at the end of the
+// line, and continues. Each malformed region is represented in the AST by an
+// ErrorNode, and every error is collected into Errors. Recover must be called
+// before Parse.
+func (t *Tree) Recover() *Tree {
+	t.recovering = true
+	t.lexer.resync = true
+	return t
+}
+
+// Lossless causes Parse to retain the source of every node, including the
+// trivia which does not affect the AST, such as the spacing and quotes within
+// tags, escape characters, and whitespace removed by trim markers. Printing
+// the AST then reproduces every unmodified node byte-for-byte; see Source.
+// Lossless returns the Tree so that calls can be chained, and must be called
+// before Parse.
+func (t *Tree) Lossless() *Tree {
+	t.lossless = true
+	return t
+}
+
+// Delims sets the delimiters used to recognize Braai tags to left and right,
+// such as "[[" and "]]", returning the Tree so that calls can be chained. The
+// closers of block tags, comments and raw sections use the same delimiters.
+// An empty delimiter is replaced by its default, "{{" or "}}". Delims must be
+// called before Parse.
+func (t *Tree) Delims(left, right string) *Tree {
+	t.lexer.delims(left, right)
+	return t
+}
+
 // New returns a *Tree which is initialized with a lexer so that parsing can
 // proceed immediately
 func New(name string, input string, blockTags []string) *Tree {
-	return &Tree{ParseName: name, lexer: NewLexer(input, blockTags), Error: nil}
+	return &Tree{ParseName: name, lexer: NewLexer(input, blockTags), Error: nil, lines: newLineIndex(input)}
 }
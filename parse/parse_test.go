@@ -1,7 +1,11 @@
 package parse
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 )
 
 type parseTest struct {
@@ -33,12 +37,18 @@ var parseTests = []parseTest{
 	{"a menagerie of braai", "And all together now! {{callout}}{{ photo_gallery \"Ashtray\", \"Garbage Can\", \"Doorknob\" size=\"big\" }}{{/callout}}", noError, `You've got an attachment in my callout! {{callout}}{{article.attachments(1235).popup}}{{/callout}}`},
 	{"a menagerie of braai, and dot commands", "And all together now! {{callout}}{{ article.attachments(1234) \"Ashtray\", \"Garbage Can\", \"Doorknob\" size=\"big\" }}{{/callout}}", noError, `You've got an attachment in my callout! {{callout}}{{article.attachments(1235).popup}}{{/callout}}`},
 	{"a menagerie of braai, and dot commands", "And all together now! {{callout}}{{ article.attachments[\"Upper Deck\"] \"Ashtray\", \"Garbage Can\", \"Doorknob\" size=\"big\" }}{{/callout}}", noError, `You've got an attachment in my callout! {{callout}}{{article.attachments(1235).popup}}{{/callout}}`},
+	{"dot command followed by attributes", "Here's a popup {{article.popup mode=\"inline\"}}", noError, `Here's a popup {{article.popup mode="inline"}}`},
+	{"escaped braai", `Write \{{product.name}} to show a name`, noError, `Write \{{product.name}} to show a name`},
+	{"raw section", `Some JSON: {{{{raw}}}}{{"a": 1}}{{{{/raw}}}}`, noError, `Some JSON: {{{{raw}}}}{{"a": 1}}{{{{/raw}}}}`},
+	{"unterminated raw section", `Some JSON: {{{{raw}}}}{{"a": 1}}`, hasError, `Some JSON: {{{{raw}}}}{{"a": 1}}`},
+	{"comment", "A note {{! check this price }} in a callout {{callout}}{{!another}}{{/callout}}", noError, `A note {{! check this price }} in a callout {{callout}}{{!another}}{{/callout}}`},
+	{"unterminated comment", "A note {{! check this price", hasError, `A note {{! check this price`},
 	{"float right", "This should be floated right: {{float_right}}{{ attachments(346360).popup }}{{/float_right}}", noError, "This should be floated right: {{float_right}}{{ article.attachments(12345).popup }}{{/float_right}}"},
 }
 
 var errorTests = []parseTest{
 	// Ensure line numbers work
-	{"unterminated", "Foo {{photo_gallery}", hasError, `unterminated:1:19: Lexical Error - Malformed end of Braai tag, should be }}`},
+	{"unterminated", "Foo {{photo_gallery}", hasError, `unterminated:1:20: Lexical Error - Malformed end of Braai tag, should be }}`},
 	{"invalidchar", "Foo\n\n{{foo?}}", hasError, `invalidchar:3:6: Lexical Error - Unexpected character U+003F '?'`},
 }
 
@@ -69,3 +79,429 @@ func TestParseErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestPositions(t *testing.T) {
+	const doc = "Intro\n  {{article.attachments(12) 'Foo' big=\"true\"}} é {{callout}}\n{{! note }}{{/callout}}"
+
+	root, err := New("positions", doc, []string{"callout"}).Parse()
+	if err != nil {
+		t.Fatalf("Unexpected Parse Error: %s", err)
+	}
+	document := root.(*DocumentNode)
+	tag := document.NodeList[1].(*BraaiTagNode)
+	block := document.NodeList[3].(*BlockTagNode)
+	comment := block.Subtree.(*DocumentNode).NodeList[1].(*CommentNode)
+
+	tests := []struct {
+		name     string
+		pos      Position
+		expected Position
+		source   string
+	}{
+		{"document", document.Pos, Position{"positions", 0, 1, 1, len(doc)}, doc},
+		{"text", document.NodeList[0].(*TextNode).Pos, Position{"positions", 0, 1, 1, 8}, "Intro\n  "},
+		{"braai tag", tag.Pos, Position{"positions", 8, 2, 3, 52}, `{{article.attachments(12) 'Foo' big="true"}}`},
+		{"dot command", tag.DotCommands[0].Pos, Position{"positions", 17, 2, 12, 33}, ".attachments(12)"},
+		{"dot argument", tag.DotCommands[0].Argument.(*SingleArgumentNode).Pos, Position{"positions", 29, 2, 24, 33}, "(12)"},
+		{"quoted argument", tag.ArgumentNodes[0].Pos, Position{"positions", 34, 2, 29, 39}, "'Foo'"},
+		{"attribute", tag.AttributePos["big"], Position{"positions", 40, 2, 35, 50}, `big="true"`},
+		{"unicode text", document.NodeList[2].(*TextNode).Pos, Position{"positions", 52, 2, 47, 56}, " é "},
+		{"block tag", block.Pos, Position{"positions", 56, 2, 50, len(doc)}, "{{callout}}\n{{! note }}{{/callout}}"},
+		{"block subtree", block.Subtree.(*DocumentNode).Pos, Position{"positions", 67, 2, 61, 79}, "\n{{! note }}"},
+		{"comment", comment.Pos, Position{"positions", 68, 3, 1, 79}, "{{! note }}"},
+	}
+
+	for _, test := range tests {
+		if test.pos != test.expected {
+			t.Errorf("%s:\n\tExpected position %#v, saw %#v", test.name, test.expected, test.pos)
+		}
+		if source := doc[test.pos.Offset:test.pos.End]; source != test.source {
+			t.Errorf("%s:\n\tExpected position to span %q, saw %q", test.name, test.source, source)
+		}
+	}
+}
+
+func TestPositionsAfterTrimming(t *testing.T) {
+	const doc = "Intro  {{- foo -}}\n  Outro"
+
+	root, err := New("trimming", doc, []string{}).Parse()
+	if err != nil {
+		t.Fatalf("Unexpected Parse Error: %s", err)
+	}
+	nodes := root.(*DocumentNode).NodeList
+	if pos := nodes[0].(*TextNode).Pos; doc[pos.Offset:pos.End] != "Intro" {
+		t.Errorf("Expected trimmed text to span \"Intro\", saw %q", doc[pos.Offset:pos.End])
+	}
+	if pos := nodes[2].(*TextNode).Pos; doc[pos.Offset:pos.End] != "Outro" || pos.Line != 2 || pos.Column != 3 {
+		t.Errorf("Expected trimmed text to span \"Outro\" at 2:3, saw %q at %s", doc[pos.Offset:pos.End], pos)
+	}
+}
+
+func TestParseRecovery(t *testing.T) {
+	const doc = "Intro {{foo?}} {{product.name}}\n{{ gallery 'open\nMiddle {{callout}}{{bar size=}}{{/callout}} {{baz}} {{/callout}} end"
+
+	root, err := New("recovery", doc, []string{"callout"}).Recover().Parse()
+	if err == nil {
+		t.Fatalf("Expected errors while recovering, but saw none")
+	}
+
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("Expected an ErrorList, saw %T", err)
+	}
+	expectedErrors := []string{
+		"recovery:1:12: Lexical Error - Unexpected character U+003F '?'",
+		"recovery:2:13: Lexical Error - Unterminated quoted argument",
+		"recovery:3:30: Lexical Error - Malformed modifier",
+		"recovery:3:53: Unexpected closing tag",
+	}
+	if len(errs) != len(expectedErrors) {
+		t.Fatalf("Expected %d errors, saw %d: %v", len(expectedErrors), len(errs), []error(errs))
+	}
+	for i, expected := range expectedErrors {
+		if errs[i].Error() != expected {
+			t.Errorf("Error %d:\n\tExpected \"%s\", saw \"%s\"", i, expected, errs[i])
+		}
+	}
+
+	var tags, errorNodes []string
+	var walk func(Node)
+	walk = func(node Node) {
+		switch n := node.(type) {
+		case *DocumentNode:
+			for _, child := range n.NodeList {
+				walk(child)
+			}
+		case *BlockTagNode:
+			tags = append(tags, n.Name)
+			walk(n.Subtree)
+		case *BraaiTagNode:
+			tags = append(tags, n.Text)
+		case *ErrorNode:
+			errorNodes = append(errorNodes, doc[n.Pos.Offset:n.Pos.End])
+		}
+	}
+	walk(root)
+
+	expectedTags := []string{"product", "callout", "baz"}
+	if strings.Join(tags, ",") != strings.Join(expectedTags, ",") {
+		t.Errorf("Expected tags %v to survive recovery, saw %v", expectedTags, tags)
+	}
+	expectedRegions := []string{"{{foo?}}", "{{ gallery 'open", "{{bar size=}}", "{{/callout}}"}
+	if strings.Join(errorNodes, "|") != strings.Join(expectedRegions, "|") {
+		t.Errorf("Expected error regions %q, saw %q", expectedRegions, errorNodes)
+	}
+}
+
+func TestParseRecoveryWithoutErrors(t *testing.T) {
+	root, err := New("recovery", "Just {{fine}}", []string{}).Recover().Parse()
+	if err != nil || root == nil {
+		t.Errorf("Expected a clean parse, saw %v", err)
+	}
+}
+
+func TestParseRecoveryUnterminatedTags(t *testing.T) {
+	tests := []struct {
+		doc      string
+		expected []string
+	}{
+		// like the end of a line, the end of the document ends a tag
+		{"{{x", nil},
+		{"a {{x y", []string{"unterminated:1:8: Unexpected end of tag in attribute list, expected ="}},
+		{"a {{x 'y", []string{"unterminated:1:8: Lexical Error - Unterminated quoted argument"}},
+		{"{{x ? {{y", []string{"unterminated:1:5: Lexical Error - Unexpected character U+003F '?'"}},
+	}
+	for _, test := range tests {
+		done := make(chan error, 1)
+		go func() {
+			_, err := New("unterminated", test.doc, []string{}).Recover().Parse()
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			errs, _ := err.(ErrorList)
+			var messages []string
+			for _, err := range errs {
+				messages = append(messages, err.Error())
+			}
+			if strings.Join(messages, "|") != strings.Join(test.expected, "|") {
+				t.Errorf("%q: Expected errors %q, saw %q", test.doc, test.expected, messages)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%q: Parsing did not finish", test.doc)
+		}
+	}
+}
+
+func TestParseRecoveryOneErrorPerTag(t *testing.T) {
+	const doc = `a {{foo = "x"}} b {{ok}} {{bar "y" = }} c`
+
+	root, err := New("malformed", doc, []string{}).Recover().Parse()
+	errs, _ := err.(ErrorList)
+	if len(errs) != 2 {
+		t.Errorf("Expected 2 errors, saw %q", errs)
+	}
+	var errorNodes int
+	for _, node := range root.(*DocumentNode).NodeList {
+		if _, ok := node.(*ErrorNode); ok {
+			errorNodes++
+		}
+	}
+	if errorNodes != 2 {
+		t.Errorf("Expected 2 ErrorNodes, saw %d", errorNodes)
+	}
+}
+
+func TestParseRecoveryLexicalErrorInBlock(t *testing.T) {
+	const doc = "{{callout}} x {{ /sidebar}} y"
+
+	_, err := New("block", doc, []string{"callout"}).Parse()
+	if err == nil || err.Error() != "block:1:18: Lexical Error - Unexpected character U+002F '/'" {
+		t.Errorf("Expected a lexical error, saw %v", err)
+	}
+
+	root, err := New("block", doc, []string{"callout"}).Recover().Parse()
+	if root == nil {
+		t.Fatalf("Expected an AST while recovering, saw %v", err)
+	}
+	errs, _ := err.(ErrorList)
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	expected := []string{
+		"block:1:18: Lexical Error - Unexpected character U+002F '/'",
+		"block:1:30: Unexpected end of document in block tag, expected block tag",
+	}
+	if strings.Join(messages, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected errors %q, saw %q", expected, messages)
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	_, err := New("syntax", "Foo\n{{callout}}Bar{{/sidebar}}", []string{"callout", "sidebar"}).Parse()
+
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Fatalf("Expected a *SyntaxError, saw %T: %v", err, err)
+	}
+	if syntaxErr.Lexical {
+		t.Errorf("Expected a parse error, saw a lexical error")
+	}
+	if syntaxErr.Pos.Line != 2 || syntaxErr.Pos.Column != 18 {
+		t.Errorf("Expected error at 2:18, saw %s", syntaxErr.Pos)
+	}
+	expected := "syntax:2:18: Mismatched block tag, opener: callout, closer: sidebar"
+	if err.Error() != expected {
+		t.Errorf("Expected \"%s\", saw \"%s\"", expected, err)
+	}
+
+	_, err = New("syntax", "{{foo?}}", []string{}).Parse()
+	if !errors.As(err, &syntaxErr) || !syntaxErr.Lexical {
+		t.Errorf("Expected a lexical *SyntaxError, saw %T: %v", err, err)
+	}
+
+	_, err = New("syntax", "{{callout}}Bar{{/sidebar}}", []string{"callout"}).Parse()
+	if !errors.As(err, &syntaxErr) || syntaxErr.Expected != "block tag" || syntaxErr.Actual != "identifier" {
+		t.Errorf("Expected a *SyntaxError for a closing identifier, saw %T: %v", err, err)
+	}
+}
+
+var printTests = []struct {
+	name, input, output string
+}{
+	{"text", "Simple *markdown*", "Simple *markdown*"},
+	{"spacing", "The {{ product.name }} and {{ article.attachments( 1235 ).popup}}", "The {{product.name}} and {{article.attachments( 1235 ).popup}}"},
+	{"command argument", "{{product(42)}} {{product['A Lens'].name}} {{product['Zoom-Lens']}}", `{{product(42)}} {{product(A Lens).name}} {{product['Zoom-Lens']}}`},
+	{"quotes", `{{gallery 'Ashtray', "Bob's Can" size='big' caption='Say "hi"'}}`, `{{gallery "Ashtray" "Bob's Can" caption='Say "hi"' size="big"}}`},
+	{"attribute order", `{{gallery size="big", name="blah", hidden=false}}`, `{{gallery hidden="false" name="blah" size="big"}}`},
+	{"bracketed", `{{product.specs["Bob's"].name}}`, `{{product.specs["Bob's"].name}}`},
+	{"block", "{{callout}} {{ product.name }} {{/callout}}", "{{callout}} {{product.name}} {{/callout}}"},
+	{"comment", "{{!   check this price  }}{{!}}", "{{! check this price }}{{!}}"},
+	{"escaped", `Write \{{product.name}}`, `Write \{{product.name}}`},
+	{"raw section", `{{{{raw}}}}{{"a": 1}} {{{{raw}}}}{{{{/raw}}}}`, `\{{"a": 1}} \{{\{{raw}}}}`},
+	{"trimmed", "Price: {{- product.price -}} !", "Price:{{product.price}}!"},
+	{"trailing backslash", `{{{{raw}}}}C:\{{{{/raw}}}}{{product.path}}`, `{{{{raw}}}}C:\{{{{/raw}}}}{{product.path}}`},
+	{"trailing brace", "{ {{- product.name}} x{ {{-callout}}{{/callout}}", "{{{{raw}}}}{{{{{/raw}}}}{{product.name}}{{{{raw}}}} x{{{{{/raw}}}}{{callout}}{{/callout}}"},
+}
+
+func TestPrint(t *testing.T) {
+	for _, test := range printTests {
+		root, err := New(test.name, test.input, []string{"callout"}).Parse()
+		if err != nil {
+			t.Errorf("%s:\n\tUnexpected Parse Error: %s", test.name, err)
+			continue
+		}
+		var buf strings.Builder
+		if err := Print(&buf, root); err != nil {
+			t.Errorf("%s:\n\tUnexpected Print Error: %s", test.name, err)
+			continue
+		}
+		if buf.String() != test.output {
+			t.Errorf("%s:\n\texpected %q\n\tgot      %q", test.name, test.output, buf.String())
+		}
+	}
+}
+
+// Printing the AST of any document, and parsing the result, must produce an
+// AST which prints identically and executes to the same output
+func TestPrintRoundTrip(t *testing.T) {
+	mux := NewHandlerMux()
+	mux.DefaultHandler(func(tag *BraaiTagNode) (string, error) {
+		return fmt.Sprintf("[%s %q %v]", tag.Text, tag.Arguments, tag.Attributes), nil
+	})
+	mux.HandleBlockFunc("callout", func(block *BlockTagNode) (string, error) {
+		out, err := block.Subtree.Execute(mux)
+		return "<aside>" + out + "</aside>", err
+	})
+	mux.HandleBlockFunc("float_right", func(block *BlockTagNode) (string, error) {
+		return block.Subtree.Execute(mux)
+	})
+
+	inputs := make([]string, 0, len(parseTests)+len(printTests))
+	for _, test := range parseTests {
+		if test.ok == noError {
+			inputs = append(inputs, test.input)
+		}
+	}
+	for _, test := range printTests {
+		inputs = append(inputs, test.input)
+	}
+	blocks := []string{"callout", "float_right"}
+	for _, input := range inputs {
+		root, err := New("roundtrip", input, blocks).Parse()
+		if err != nil {
+			t.Errorf("%s:\n\tUnexpected Parse Error: %s", input, err)
+			continue
+		}
+		var first, second strings.Builder
+		if err := Print(&first, root); err != nil {
+			t.Errorf("%s:\n\tUnexpected Print Error: %s", input, err)
+			continue
+		}
+		reparsed, err := New("roundtrip", first.String(), blocks).Parse()
+		if err != nil {
+			t.Errorf("%s:\n\tPrinted %q which does not parse: %s", input, first.String(), err)
+			continue
+		}
+		if err := Print(&second, reparsed); err != nil || second.String() != first.String() {
+			t.Errorf("%s:\n\tPrinted %q then %q (%v)", input, first.String(), second.String(), err)
+		}
+		expected, _ := root.Execute(mux)
+		if actual, _ := reparsed.Execute(mux); actual != expected {
+			t.Errorf("%s:\n\texpected output %q\n\tgot             %q", input, expected, actual)
+		}
+	}
+}
+
+func TestPrintDelims(t *testing.T) {
+	root, err := New("delims", "[[ product.name ]] {{x}} \\[[y]]", nil).Delims("[[", "]]").Parse()
+	if err != nil {
+		t.Fatalf("Unexpected Parse Error: %s", err)
+	}
+	var buf strings.Builder
+	if err := (&Printer{LeftDelim: "[[", RightDelim: "]]"}).Print(&buf, root); err != nil {
+		t.Fatalf("Unexpected Print Error: %s", err)
+	}
+	if expected := `[[product.name]] {{x}} \[[y]]`; buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestPrintErrorNode(t *testing.T) {
+	root, _ := New("recovered", "A {{product.name?}} B", nil).Recover().Parse()
+	var buf strings.Builder
+	err := Print(&buf, root)
+	if err == nil || !strings.HasPrefix(err.Error(), "recovered:1:3: Cannot print malformed tag") {
+		t.Errorf("expected an error for the malformed tag, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing to be printed, got %q", buf.String())
+	}
+}
+
+func TestLosslessPrint(t *testing.T) {
+	inputs := []string{
+		"Hi {{ product.name  size='big' , zoom=true }} \\{{x}} {{{{raw}}}}{{y}}{{{{/raw}}}}  {{- callout -}}  a {{!  note }} {{-/callout -}}   end",
+		"{{ product( 42 ).specs['Color'] 'a', \"b\" }}\n{{float_right}}{{callout}} x {{/callout}}{{/float_right}}\n",
+		"  {{-x-}}  {{{{raw}}}}\\{{{{/raw}}}}\\{{y -}}",
+	}
+	for _, test := range parseTests {
+		if test.ok == noError {
+			inputs = append(inputs, test.input)
+		}
+	}
+	for _, input := range inputs {
+		root, err := New("lossless", input, []string{"callout", "float_right"}).Lossless().Parse()
+		if err != nil {
+			t.Errorf("%s:\n\tUnexpected Parse Error: %s", input, err)
+			continue
+		}
+		var buf strings.Builder
+		if err := Print(&buf, root); err != nil {
+			t.Errorf("%s:\n\tUnexpected Print Error: %s", input, err)
+		} else if buf.String() != input {
+			t.Errorf("expected %q\n\tgot      %q", input, buf.String())
+		}
+	}
+}
+
+func TestLosslessModified(t *testing.T) {
+	const input = "A  {{- product.name  size='big' -}}  B {{ other 'x' }} {{callout -}}  {{ product.name }}  {{-/callout}} {{! note }}"
+	root, err := New("lossless", input, []string{"callout", "aside"}).Lossless().Parse()
+	if err != nil {
+		t.Fatalf("Unexpected Parse Error: %s", err)
+	}
+	nodes := root.(*DocumentNode).NodeList
+	nodes[1].(*BraaiTagNode).Attributes["size"] = "small"
+	block := nodes[5].(*BlockTagNode)
+	block.Name = "aside"
+	block.Subtree.(*DocumentNode).NodeList[1].(*BraaiTagNode).DotCommands[0].Text = "title"
+
+	var buf strings.Builder
+	if err := Print(&buf, root); err != nil {
+		t.Fatalf("Unexpected Print Error: %s", err)
+	}
+	expected := `A  {{- product.name size="small" -}}  B {{ other 'x' }} {{aside -}}  {{ product.title }}  {{-/aside}} {{! note }}`
+	if buf.String() != expected {
+		t.Errorf("expected %q\n\tgot      %q", expected, buf.String())
+	}
+}
+
+func TestLosslessModifiedTrivia(t *testing.T) {
+	tests := []struct {
+		input, output string
+	}{
+		{"x {{- y -}} z", "x {{- why -}} z"},
+		{"x\n{{-y-}}\nz", "x\n{{-why-}}\nz"},
+		{"x {{ y(123) }} z", "x {{ why(123) }} z"},
+		{"{{-y}}\n{{y -}}\n", "{{-why}}\n{{why -}}\n"},
+	}
+	for _, test := range tests {
+		root, err := New("lossless", test.input, nil).Lossless().Parse()
+		if err != nil {
+			t.Fatalf("Unexpected Parse Error: %s", err)
+		}
+		for _, node := range root.(*DocumentNode).NodeList {
+			if tag, ok := node.(*BraaiTagNode); ok {
+				tag.Text = "why"
+			}
+		}
+		var buf strings.Builder
+		if err := Print(&buf, root); err != nil {
+			t.Fatalf("Unexpected Print Error: %s", err)
+		}
+		if buf.String() != test.output {
+			t.Errorf("%q: expected %q\n\tgot      %q", test.input, test.output, buf.String())
+		}
+	}
+}
+
+func TestLosslessRecovery(t *testing.T) {
+	const input = "A {{ product.name? }} B {{ x }}"
+	root, _ := New("lossless", input, nil).Recover().Lossless().Parse()
+	var buf strings.Builder
+	if err := Print(&buf, root); err != nil || buf.String() != input {
+		t.Errorf("expected %q, got %q (%v)", input, buf.String(), err)
+	}
+}
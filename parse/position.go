@@ -0,0 +1,65 @@
+package parse
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A Position describes the span of source text from which a Node was parsed.
+// Lines and columns are 1-based, with columns counted in runes. Offsets are
+// byte offsets into the document.
+type Position struct {
+	Filename string // the name of the document being parsed
+	Offset   int    // byte offset of the beginning of the span
+	Line     int    // line of the beginning of the span
+	Column   int    // column of the beginning of the span
+	End      int    // byte offset immediately following the span
+}
+
+// String formats the beginning of the span as filename:line:column, which is
+// the form used to prefix error messages
+func (p Position) String() string {
+	return p.Filename + ":" + strconv.Itoa(p.Line) + ":" + strconv.Itoa(p.Column)
+}
+
+// IsValid reports whether the Position was produced by the parser
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+// A lineIndex converts byte offsets within a document into lines and columns
+type lineIndex struct {
+	input    string
+	newlines []int // offsets of every newline in input
+}
+
+func newLineIndex(input string) *lineIndex {
+	idx := &lineIndex{input: input}
+	for offset := strings.IndexByte(input, '\n'); offset >= 0; {
+		idx.newlines = append(idx.newlines, offset)
+		next := strings.IndexByte(input[offset+1:], '\n')
+		if next < 0 {
+			break
+		}
+		offset += next + 1
+	}
+	return idx
+}
+
+// position returns the Position spanning the offsets start to end
+func (idx *lineIndex) position(name string, start, end int) Position {
+	line := sort.SearchInts(idx.newlines, start)
+	lineStart := 0
+	if line > 0 {
+		lineStart = idx.newlines[line-1] + 1
+	}
+	return Position{
+		Filename: name,
+		Offset:   start,
+		Line:     line + 1,
+		Column:   utf8.RuneCountInString(idx.input[lineStart:start]) + 1,
+		End:      end,
+	}
+}
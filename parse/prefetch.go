@@ -0,0 +1,131 @@
+package parse
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// A KeyFunc declares the keys a BraaiTag needs loaded before it is executed,
+// such as the ID 12345 of {{article.attachments(12345)}}
+type KeyFunc func(tag *BraaiTagNode) []string
+
+// A BatchLoadFunc loads every key collected for a tag at once, returning the
+// loaded value for each key. Keys missing from the result are simply not
+// available to the handler.
+type BatchLoadFunc func(ctx context.Context, keys []string) (map[string]interface{}, error)
+
+// batchLoader pairs the KeyFunc and BatchLoadFunc registered for a tag
+type batchLoader struct {
+	keys KeyFunc
+	load BatchLoadFunc
+}
+
+// HandleBatch registers a KeyFunc and BatchLoadFunc for the Braai tag named
+// ident, to be used by Prefetch. The handler of the tag is registered
+// separately, and retrieves the loaded values with Loaded.
+func (h *HandlerMux) HandleBatch(ident string, keys KeyFunc, load BatchLoadFunc) {
+	h.batchLoaders[ident] = batchLoader{keys, load}
+}
+
+// A KeyCollector is a Visitor which collects the keys declared by the KeyFuncs
+// registered with a HandlerMux. Keys are grouped by tag, and appear once each
+// in the order they were first encountered.
+type KeyCollector struct {
+	mux  *HandlerMux
+	keys map[string][]string
+	seen map[string]map[string]bool
+}
+
+// NewKeyCollector returns a KeyCollector for the KeyFuncs registered with mux
+func NewKeyCollector(mux *HandlerMux) *KeyCollector {
+	return &KeyCollector{
+		mux:  mux,
+		keys: make(map[string][]string),
+		seen: make(map[string]map[string]bool),
+	}
+}
+
+// AcceptTag collects the keys declared for the BraaiTag, if any
+func (k *KeyCollector) AcceptTag(b *BraaiTagNode) {
+	loader, ok := k.mux.batchLoaders[b.Text]
+	if !ok {
+		return
+	}
+	if k.seen[b.Text] == nil {
+		k.seen[b.Text] = make(map[string]bool)
+	}
+	for _, key := range loader.keys(b) {
+		if !k.seen[b.Text][key] {
+			k.seen[b.Text][key] = true
+			k.keys[b.Text] = append(k.keys[b.Text], key)
+		}
+	}
+}
+
+// AcceptBlockTag is a no-op, since block tags have no KeyFuncs
+func (k *KeyCollector) AcceptBlockTag(b *BlockTagNode) {
+	// NOP
+}
+
+// AcceptTextNode is a no-op, since text has no keys
+func (k *KeyCollector) AcceptTextNode(t *TextNode) {
+	// NOP
+}
+
+// Keys returns the keys collected so far, grouped by tag
+func (k *KeyCollector) Keys() map[string][]string {
+	return k.keys
+}
+
+// resultsKey is the Context key under which Prefetch stores loaded values
+type resultsKey struct{}
+
+// Prefetch collects the keys needed by every tag in node, invokes the
+// BatchLoadFunc of each tag once with all of its keys, and returns a Context
+// carrying the loaded values. Executing node with the returned Context, using
+// ExecuteContext or ExecuteToContext, makes the values available to handlers
+// through Loaded. Values loaded by an earlier call to Prefetch, whose Context
+// ctx carries, remain available alongside the new ones.
+func Prefetch(ctx context.Context, node Node, mux *HandlerMux) (context.Context, error) {
+	collector := NewKeyCollector(mux)
+	node.Visit(collector)
+	keys := collector.Keys()
+
+	idents := make([]string, 0, len(keys))
+	for ident := range keys {
+		idents = append(idents, ident)
+	}
+	sort.Strings(idents)
+
+	results := make(map[string]map[string]interface{})
+	if previous, ok := ctx.Value(resultsKey{}).(map[string]map[string]interface{}); ok {
+		for ident, values := range previous {
+			results[ident] = values
+		}
+	}
+	for _, ident := range idents {
+		values, err := mux.batchLoaders[ident].load(ctx, keys[ident])
+		if err != nil {
+			return ctx, fmt.Errorf("Batch load failed for %s tags: %w", ident, err)
+		}
+		// the previous values are copied, since they belong to ctx
+		merged := make(map[string]interface{}, len(results[ident])+len(values))
+		for key, value := range results[ident] {
+			merged[key] = value
+		}
+		for key, value := range values {
+			merged[key] = value
+		}
+		results[ident] = merged
+	}
+	return context.WithValue(ctx, resultsKey{}, results), nil
+}
+
+// Loaded returns the value loaded by Prefetch for key, on behalf of the tag
+// named ident
+func Loaded(ctx context.Context, ident, key string) (interface{}, bool) {
+	results, _ := ctx.Value(resultsKey{}).(map[string]map[string]interface{})
+	value, ok := results[ident][key]
+	return value, ok
+}
@@ -0,0 +1,348 @@
+package parse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// A Printer converts an AST back into Braai source. The output is canonical:
+// tags are printed with single spaces between their parts, arguments and
+// attribute values use double quotes unless they contain one, attributes are
+// sorted by name, and commas and trim markers are omitted. Parsing the output
+// produces an equivalent AST, whose output is in turn identical. Whitespace
+// removed by trim markers is not restored.
+//
+// Nodes parsed by a lossless Tree are instead printed exactly as they
+// appeared in the document for as long as they are unmodified, and keep their
+// trivia, trim markers and spacing once modified; see Source. Otherwise,
+// ErrorNodes cannot be printed, so a recovered AST containing them is
+// rejected.
+type Printer struct {
+	// LeftDelim and RightDelim are the delimiters of the printed tags. Empty
+	// delimiters are replaced by their defaults, "{{" and "}}".
+	LeftDelim  string
+	RightDelim string
+}
+
+// Print writes node to w as Braai source using the default delimiters
+func Print(w io.Writer, node Node) error {
+	return (&Printer{}).Print(w, node)
+}
+
+// Print writes node to w as Braai source. Nothing is written if the node
+// cannot be printed.
+func (p *Printer) Print(w io.Writer, node Node) error {
+	s := &printer{buf: &bytes.Buffer{}, left: p.LeftDelim, right: p.RightDelim}
+	if s.left == "" {
+		s.left = defaultLeftDelim
+	}
+	if s.right == "" {
+		s.right = defaultRightDelim
+	}
+	if err := s.node(node, false); err != nil {
+		return err
+	}
+	_, err := s.buf.WriteTo(w)
+	return err
+}
+
+// printer holds the state of a single call to Printer.Print
+type printer struct {
+	buf   *bytes.Buffer
+	left  string
+	right string
+}
+
+// node prints any Node. Within a block, the text of a DocumentNode is followed
+// by the closer of the block.
+func (p *printer) node(node Node, inBlock bool) error {
+	if src := p.verbatim(node); src != nil {
+		switch n := node.(type) {
+		case *DocumentNode:
+		case *BlockTagNode:
+			p.buf.WriteString(src.Leading + src.Text)
+			if err := p.node(n.Subtree, true); err != nil {
+				return err
+			}
+			p.buf.WriteString(src.Closer + src.Trailing)
+			return nil
+		default:
+			p.buf.WriteString(src.Leading + src.Text + src.Trailing)
+			return nil
+		}
+	}
+	if src := p.modified(node); src != nil {
+		return p.reframe(node, src)
+	}
+	switch n := node.(type) {
+	case *DocumentNode:
+		return p.document(n, inBlock)
+	case *TextNode:
+		return p.text(string(n.Text), false)
+	case *CommentNode:
+		return p.comment(n)
+	case *BraaiTagNode:
+		return p.tag(n)
+	case *BlockTagNode:
+		return p.block(n)
+	case *ErrorNode:
+		return fmt.Errorf("%s: Cannot print malformed tag: %s", n.Pos, n.Err)
+	default:
+		return fmt.Errorf("Cannot print %T", node)
+	}
+}
+
+// document prints the NodeList of d, combining adjacent TextNodes so that
+// their escaping takes the text on either side into account
+func (p *printer) document(d *DocumentNode, inBlock bool) error {
+	for i := 0; i < len(d.NodeList); i++ {
+		if !p.canonicalText(d.NodeList[i]) {
+			if err := p.node(d.NodeList[i], false); err != nil {
+				return err
+			}
+			continue
+		}
+		var text bytes.Buffer
+		for ; i < len(d.NodeList) && p.canonicalText(d.NodeList[i]); i++ {
+			text.Write(d.NodeList[i].(*TextNode).Text)
+		}
+		i--
+		if err := p.text(text.String(), i+1 < len(d.NodeList) || inBlock); err != nil {
+			return err
+		}
+	}
+	if src := p.verbatim(d); src != nil {
+		p.buf.WriteString(src.Trailing)
+	}
+	return nil
+}
+
+// canonicalText reports whether node is a TextNode to be printed in canonical
+// form
+func (p *printer) canonicalText(node Node) bool {
+	_, ok := node.(*TextNode)
+	return ok && p.verbatim(node) == nil
+}
+
+// verbatim returns the Source of node if the node can be printed from it,
+// since it is unmodified and was parsed with the same delimiters
+func (p *printer) verbatim(node Node) *Source {
+	src := sourceOf(node)
+	if src == nil || src.left != p.left || src.right != p.right {
+		return nil
+	}
+	if _, ok := node.(*ErrorNode); !ok && p.shallow(node) != src.canonical {
+		return nil
+	}
+	return src
+}
+
+// modified returns the Source of node if it is a BraaiTagNode or BlockTagNode
+// which was parsed with the same delimiters, but has since been modified
+func (p *printer) modified(node Node) *Source {
+	switch node.(type) {
+	case *BraaiTagNode, *BlockTagNode:
+		if src := sourceOf(node); src != nil && src.left == p.left && src.right == p.right {
+			return src
+		}
+	}
+	return nil
+}
+
+// reframe prints a modified BraaiTag or BlockTag along with the trivia of its
+// Source, replacing only the contents of its tags
+func (p *printer) reframe(node Node, src *Source) error {
+	p.buf.WriteString(src.Leading)
+	switch n := node.(type) {
+	case *BraaiTagNode:
+		buf := p.buf
+		p.buf = &bytes.Buffer{}
+		err := p.tag(n)
+		tag := p.buf.String()
+		p.buf = buf
+		if err != nil {
+			return err
+		}
+		p.buf.WriteString(p.frame(src.Text, tag))
+	case *BlockTagNode:
+		p.buf.WriteString(p.frame(src.Text, p.left+n.Name+p.right))
+		if n.Subtree != nil {
+			if err := p.node(n.Subtree, true); err != nil {
+				return err
+			}
+		}
+		p.buf.WriteString(p.frame(src.Closer, p.left+"/"+n.Name+p.right))
+	}
+	p.buf.WriteString(src.Trailing)
+	return nil
+}
+
+// frame replaces the contents of the tag within src, which may be followed
+// or preceded by whitespace it trims, with those of tag, a tag in canonical
+// form. The delimiters, trim markers and spacing of the original remain, as
+// in {{- name -}}.
+func (p *printer) frame(src, tag string) string {
+	start, end := strings.Index(src, p.left), strings.LastIndex(src, p.right)
+	if start < 0 || end < start+len(p.left) {
+		return tag
+	}
+	start += len(p.left)
+	inner := src[start:end]
+	head := inner[:len(inner)-len(strings.TrimLeft(strings.TrimPrefix(inner, trimMarker), " \t"))]
+	rest := inner[len(head):]
+	tail := rest[len(strings.TrimRight(strings.TrimSuffix(rest, trimMarker), " \t")):]
+	contents := tag[len(p.left) : len(tag)-len(p.right)]
+	return src[:start] + head + contents + tail + src[end:]
+}
+
+// shallow returns the canonical form of node, excluding any nodes within it,
+// against which its Source is compared to detect modifications
+func (p *printer) shallow(node Node) string {
+	buf := p.buf
+	p.buf = &bytes.Buffer{}
+	defer func() {
+		p.buf = buf
+	}()
+	switch n := node.(type) {
+	case *TextNode:
+		return string(n.Text)
+	case *BlockTagNode:
+		return n.Name
+	case *CommentNode:
+		p.comment(n)
+	case *BraaiTagNode:
+		p.tag(n)
+	}
+	return p.buf.String()
+}
+
+// text prints text, escaping any left delimiters within it. If a tag follows
+// the text, and the text ends in a way which would alter the meaning of the
+// tag's left delimiter, the text is printed as a raw section instead.
+func (p *printer) text(text string, tagFollows bool) error {
+	if tagFollows && (strings.HasSuffix(text, escape) || endsWithPrefix(text, p.left)) {
+		raw := p.left + p.left + "raw" + p.right + p.right
+		closer := p.left + p.left + "/raw" + p.right + p.right
+		if strings.Contains(text, closer) {
+			return fmt.Errorf("Cannot print text containing %s before a tag", closer)
+		}
+		p.buf.WriteString(raw + text + closer)
+		return nil
+	}
+	p.buf.WriteString(strings.Replace(text, p.left, escape+p.left, -1))
+	return nil
+}
+
+// endsWithPrefix reports whether text ends with a proper prefix of delim,
+// such as the { of {{
+func endsWithPrefix(text, delim string) bool {
+	for i := 1; i < len(delim); i++ {
+		if strings.HasSuffix(text, delim[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *printer) comment(c *CommentNode) error {
+	if strings.Contains(c.Text, p.right) {
+		return fmt.Errorf("%s: Cannot print comment containing %s", c.Pos, p.right)
+	}
+	if c.Text == "" {
+		p.buf.WriteString(p.left + "!" + p.right)
+	} else {
+		p.buf.WriteString(p.left + "! " + c.Text + " " + p.right)
+	}
+	return nil
+}
+
+func (p *printer) block(b *BlockTagNode) error {
+	p.buf.WriteString(p.left + b.Name + p.right)
+	if b.Subtree != nil {
+		if err := p.node(b.Subtree, true); err != nil {
+			return err
+		}
+	}
+	p.buf.WriteString(p.left + "/" + b.Name + p.right)
+	return nil
+}
+
+// tag prints a BraaiTag in the form
+//   {{command(argument).dot(argument) "argument" key="value"}}
+func (p *printer) tag(b *BraaiTagNode) error {
+	p.buf.WriteString(p.left + b.Text)
+	args := b.Arguments
+	if b.CommandArgument && len(args) > 0 {
+		if err := p.singleArgument(b, args[0]); err != nil {
+			return err
+		}
+		args = args[1:]
+	}
+	for _, cmd := range b.DotCommands {
+		p.buf.WriteString("." + cmd.Text)
+		if cmd.Argument == nil {
+			continue
+		}
+		arg, ok := cmd.Argument.(*SingleArgumentNode)
+		if !ok {
+			return fmt.Errorf("%s: Cannot print %T as argument of dot command %s", b.Pos, cmd.Argument, cmd.Text)
+		}
+		if err := p.singleArgument(b, arg.Text); err != nil {
+			return err
+		}
+	}
+	for _, arg := range args {
+		p.buf.WriteString(" ")
+		if err := p.quoted(b, arg); err != nil {
+			return err
+		}
+	}
+	keys := make([]string, 0, len(b.Attributes))
+	for key := range b.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		p.buf.WriteString(" " + key + "=")
+		if err := p.quoted(b, b.Attributes[key]); err != nil {
+			return err
+		}
+	}
+	p.buf.WriteString(p.right)
+	return nil
+}
+
+// singleArgument prints the argument of a command or dot command in
+// parentheses, or in brackets if it contains characters which are not
+// permitted in parentheses
+func (p *printer) singleArgument(b *BraaiTagNode, arg string) error {
+	if strings.Trim(arg, alphaNum) == "" {
+		p.buf.WriteString("(" + arg + ")")
+		return nil
+	}
+	switch {
+	case !strings.Contains(arg, "'"):
+		p.buf.WriteString("['" + arg + "']")
+	case !strings.Contains(arg, `"`):
+		p.buf.WriteString(`["` + arg + `"]`)
+	default:
+		return fmt.Errorf("%s: Cannot print argument %s of %s tag, which contains both kinds of quote", b.Pos, arg, b.Text)
+	}
+	return nil
+}
+
+// quoted prints a positional argument or attribute value in quotes
+func (p *printer) quoted(b *BraaiTagNode, value string) error {
+	switch {
+	case !strings.Contains(value, `"`):
+		p.buf.WriteString(`"` + value + `"`)
+	case !strings.Contains(value, "'"):
+		p.buf.WriteString("'" + value + "'")
+	default:
+		return fmt.Errorf("%s: Cannot print value %s of %s tag, which contains both kinds of quote", b.Pos, value, b.Text)
+	}
+	return nil
+}
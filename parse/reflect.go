@@ -0,0 +1,367 @@
+package parse
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// call binds the arguments of the BraaiTag to the parameters of fn and
+// invokes it, returning the resulting value. The argument of the dot command
+// is always bound first, and the positional arguments and attributes of the
+// tag are only bound when final is true.
+func call(b *BraaiTagNode, name string, fn reflect.Value, arg *SingleArgumentNode, final bool) (reflect.Value, error) {
+	if err := checkResults(b, name, fn.Type()); err != nil {
+		return reflect.Value{}, err
+	}
+	positional, attrs := arguments(b, arg, final)
+	args, err := bind(b, name, fn.Type(), positional, attrs)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	out := fn.Call(args)
+	if len(out) == 2 {
+		if err, _ := out[1].Interface().(error); err != nil {
+			return reflect.Value{}, err
+		}
+	}
+	return out[0], nil
+}
+
+// check ensures that the arguments of the BraaiTag can be bound to the
+// parameters of a function of type fnType, as call would, without invoking it
+func check(b *BraaiTagNode, name string, fnType reflect.Type, arg *SingleArgumentNode, final bool) error {
+	if err := checkResults(b, name, fnType); err != nil {
+		return err
+	}
+	positional, attrs := arguments(b, arg, final)
+	_, err := bind(b, name, fnType, positional, attrs)
+	return err
+}
+
+// arguments returns the positional arguments and attributes to be bound to a
+// function invoked by call. Arguments without a node of their own, such as
+// those supplied by a schema's defaults, are positioned at the tag.
+func arguments(b *BraaiTagNode, arg *SingleArgumentNode, final bool) ([]*SingleArgumentNode, map[string]string) {
+	var positional []*SingleArgumentNode
+	if arg != nil {
+		positional = append(positional, arg)
+	}
+	var attrs map[string]string
+	if final {
+		for i, text := range b.Arguments {
+			pos := b.Pos
+			if i < len(b.ArgumentNodes) {
+				pos = b.ArgumentNodes[i].Pos
+			}
+			positional = append(positional, &SingleArgumentNode{Text: text, Pos: pos})
+		}
+		attrs = b.Attributes
+	}
+	return positional, attrs
+}
+
+// checkResults ensures that a function of type fnType returns a value and an
+// optional error, as required by call
+func checkResults(b *BraaiTagNode, name string, fnType reflect.Type) error {
+	if !returnsValue(fnType) {
+		return b.bindError(b.Pos, "Cannot call `%s`, which must return a value and an optional error", name)
+	}
+	return nil
+}
+
+// returnsValue reports whether a function of type fnType returns a value and
+// an optional error
+func returnsValue(fnType reflect.Type) bool {
+	switch fnType.NumOut() {
+	case 1:
+		return true
+	case 2:
+		return fnType.Out(1) == errorType
+	default:
+		return false
+	}
+}
+
+// errorType is the reflect.Type of the error interface
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// bind converts the positional arguments and attributes into values suitable
+// for calling a function of type fnType
+func bind(b *BraaiTagNode, name string, fnType reflect.Type, positional []*SingleArgumentNode, attrs map[string]string) ([]reflect.Value, error) {
+	args := make([]reflect.Value, 0, fnType.NumIn())
+	for i := 0; i < fnType.NumIn(); i++ {
+		paramType := fnType.In(i)
+		variadic := fnType.IsVariadic() && i == fnType.NumIn()-1
+
+		switch {
+		case isOptions(paramType):
+			opts, err := bindOptions(b, name, paramType, attrs)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, opts)
+		case variadic:
+			for _, value := range positional {
+				converted, err := convert(value.Text, paramType.Elem())
+				if err != nil {
+					return nil, b.bindError(value.Pos, "Cannot bind argument %q to `%s`: %s", value.Text, name, err)
+				}
+				args = append(args, converted)
+			}
+			positional = nil
+		case paramType.Kind() == reflect.Slice:
+			slice := reflect.MakeSlice(paramType, 0, len(positional))
+			for _, value := range positional {
+				converted, err := convert(value.Text, paramType.Elem())
+				if err != nil {
+					return nil, b.bindError(value.Pos, "Cannot bind argument %q to `%s`: %s", value.Text, name, err)
+				}
+				slice = reflect.Append(slice, converted)
+			}
+			args = append(args, slice)
+			positional = nil
+		default:
+			if len(positional) == 0 {
+				return nil, b.bindError(b.Pos, "Missing argument %d to `%s`", i+1, name)
+			}
+			converted, err := convert(positional[0].Text, paramType)
+			if err != nil {
+				return nil, b.bindError(positional[0].Pos, "Cannot bind argument %q to `%s`: %s", positional[0].Text, name, err)
+			}
+			args = append(args, converted)
+			positional = positional[1:]
+		}
+	}
+	if len(positional) > 0 {
+		unused := make([]string, len(positional))
+		for i, arg := range positional {
+			unused[i] = arg.Text
+		}
+		return nil, b.bindError(positional[0].Pos, "Too many arguments to `%s`, %q unused", name, unused)
+	}
+	return args, nil
+}
+
+// isOptions reports whether a parameter should receive the attributes of a
+// tag. Any struct, or pointer to a struct, is considered an options struct.
+func isOptions(paramType reflect.Type) bool {
+	if paramType.Kind() == reflect.Ptr {
+		paramType = paramType.Elem()
+	}
+	return paramType.Kind() == reflect.Struct
+}
+
+// bindOptions populates a new options struct of the given type from attrs.
+// Fields are matched using their `brush` tag, or their name if untagged.
+// Fields tagged with "-" are never populated.
+func bindOptions(b *BraaiTagNode, name string, optsType reflect.Type, attrs map[string]string) (reflect.Value, error) {
+	structType := optsType
+	if optsType.Kind() == reflect.Ptr {
+		structType = optsType.Elem()
+	}
+	opts := reflect.New(structType)
+
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+		key := field.Tag.Get("brush")
+		if key == "-" {
+			continue
+		}
+		var value string
+		var ok bool
+		if key != "" {
+			value, ok = attrs[key]
+		} else {
+			key, value, ok = lookupFold(attrs, field.Name)
+		}
+		if !ok {
+			continue
+		}
+		converted, err := convert(value, field.Type)
+		if err != nil {
+			pos, ok := b.AttributePos[key]
+			if !ok {
+				pos = b.Pos
+			}
+			return reflect.Value{}, b.bindError(pos, "Cannot bind attribute %s=%q to `%s`: %s", key, value, name, err)
+		}
+		opts.Elem().Field(i).Set(converted)
+	}
+
+	if optsType.Kind() == reflect.Ptr {
+		return opts, nil
+	}
+	return opts.Elem(), nil
+}
+
+// lookupFold finds an attribute whose name matches fieldName, ignoring case
+// and underscores
+func lookupFold(attrs map[string]string, fieldName string) (string, string, bool) {
+	for key, value := range attrs {
+		if strings.EqualFold(strings.Replace(key, "_", "", -1), fieldName) {
+			return key, value, true
+		}
+	}
+	return "", "", false
+}
+
+// convert transforms the text of an argument into a value of type typ.
+// Slices are converted from comma-separated lists.
+func convert(text string, typ reflect.Type) (reflect.Value, error) {
+	value := reflect.New(typ).Elem()
+	switch typ.Kind() {
+	case reflect.String:
+		value.SetString(text)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return value, fmt.Errorf("expected a boolean")
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(strings.TrimSpace(text), 10, typ.Bits())
+		if err != nil {
+			return value, fmt.Errorf("expected an integer")
+		}
+		value.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(strings.TrimSpace(text), 10, typ.Bits())
+		if err != nil {
+			return value, fmt.Errorf("expected an unsigned integer")
+		}
+		value.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(text), typ.Bits())
+		if err != nil {
+			return value, fmt.Errorf("expected a number")
+		}
+		value.SetFloat(f)
+	case reflect.Slice:
+		for _, part := range strings.Split(text, ",") {
+			elem, err := convert(strings.TrimSpace(part), typ.Elem())
+			if err != nil {
+				return value, err
+			}
+			value = reflect.Append(value, elem)
+		}
+	case reflect.Ptr:
+		elem, err := convert(text, typ.Elem())
+		if err != nil {
+			return value, err
+		}
+		value.Set(reflect.New(typ.Elem()))
+		value.Elem().Set(elem)
+	case reflect.Interface:
+		if reflect.TypeOf(text).Implements(typ) == false {
+			return value, fmt.Errorf("cannot convert to %s", typ)
+		}
+		value.Set(reflect.ValueOf(text))
+	default:
+		return value, fmt.Errorf("cannot convert to %s", typ)
+	}
+	return value, nil
+}
+
+// findMethod looks up the named method on receiver, dereferencing interfaces
+// and taking the address of values so that pointer methods can be found
+func findMethod(receiver reflect.Value, name string) reflect.Value {
+	for receiver.Kind() == reflect.Interface && !receiver.IsNil() {
+		receiver = receiver.Elem()
+	}
+	if receiver.IsValid() == false {
+		return reflect.Value{}
+	}
+	if method := receiver.MethodByName(name); method.IsValid() {
+		return method
+	}
+	if receiver.Kind() != reflect.Ptr {
+		ptr := reflect.New(receiver.Type())
+		ptr.Elem().Set(receiver)
+		return ptr.MethodByName(name)
+	}
+	return reflect.Value{}
+}
+
+// nilReceiver reports whether invoking the named method on receiver would
+// dereference nil, as it would for a nil interface, or for a nil pointer
+// whose method has a value receiver
+func nilReceiver(receiver reflect.Value, name string) bool {
+	for receiver.Kind() == reflect.Interface && !receiver.IsNil() {
+		receiver = receiver.Elem()
+	}
+	switch receiver.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Ptr:
+		if !receiver.IsNil() {
+			return false
+		}
+		_, ok := receiver.Type().Elem().MethodByName(name)
+		return ok
+	}
+	return false
+}
+
+// methodType returns the type of the named method of typ, excluding the
+// receiver. Like findMethod, it considers the methods of a pointer to typ. ok
+// is false if the method cannot be found.
+func methodType(typ reflect.Type, name string) (fnType reflect.Type, ok bool) {
+	if typ.Kind() == reflect.Interface {
+		method, ok := typ.MethodByName(name)
+		return method.Type, ok
+	}
+	method, ok := typ.MethodByName(name)
+	if !ok && typ.Kind() != reflect.Ptr {
+		method, ok = reflect.PtrTo(typ).MethodByName(name)
+	}
+	if !ok {
+		return nil, false
+	}
+
+	in := make([]reflect.Type, 0, method.Type.NumIn()-1)
+	for i := 1; i < method.Type.NumIn(); i++ {
+		in = append(in, method.Type.In(i))
+	}
+	out := make([]reflect.Type, 0, method.Type.NumOut())
+	for i := 0; i < method.Type.NumOut(); i++ {
+		out = append(out, method.Type.Out(i))
+	}
+	return reflect.FuncOf(in, out, method.Type.IsVariadic()), true
+}
+
+// methodName converts a dot command such as manufacturer_specs into the name
+// of the method which handles it, ManufacturerSpecs
+func methodName(cmd string) string {
+	parts := strings.Split(cmd, "_")
+	for i, part := range parts {
+		parts[i] = strings.Title(part)
+	}
+	return strings.Join(parts, "")
+}
+
+// render produces the output of a value at the end of a dot command chain
+func render(value reflect.Value) string {
+	if value.IsValid() == false {
+		return ""
+	}
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		if value.IsNil() {
+			return ""
+		}
+	}
+	switch v := value.Interface().(type) {
+	case string:
+		return v
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
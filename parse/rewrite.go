@@ -0,0 +1,85 @@
+package parse
+
+// An Action tells Rewrite what to do with the Node passed to a RewriteFunc
+type Action int
+
+const (
+	Continue     Action = iota // replace the node with the one returned, and rewrite the nodes within it
+	Skip                       // replace the node with the one returned, leaving the nodes within it alone
+	Delete                     // remove the node, ignoring the one returned
+	InsertBefore               // insert the returned node before this one, which is kept and rewritten
+	InsertAfter                // insert the returned node after this one, which is kept and rewritten
+)
+
+// A RewriteFunc is called by Rewrite for every Node in an AST. To keep a node
+// as it is, return it along with Continue.
+type RewriteFunc func(node Node) (Node, Action)
+
+// Rewrite transforms the AST rooted at node by calling fn for each Node in
+// turn, beginning with node itself, and applying the Action it returns. Nodes
+// are visited in document order, with a DocumentNode or BlockTagNode visited
+// before the nodes within it, which include the Subtree of a block tag.
+// Inserted nodes are not visited, and neither is a replacement node itself,
+// although the nodes within it are rewritten unless fn returns Skip. Returning
+// a nil Node along with Continue or Skip is equivalent to Delete.
+//
+// The NodeList of each DocumentNode and the Subtree of each BlockTagNode are
+// modified in place. Rewrite returns the new root of the AST, which is nil if
+// node was deleted, or a DocumentNode holding every node if others were
+// inserted beside it. The Subtree of a block tag is never nil: deleting it
+// leaves an empty DocumentNode.
+//
+// The DotCommands and arguments of a BraaiTagNode are not visited
+// separately. To change them, modify the BraaiTagNode or replace it.
+func Rewrite(node Node, fn RewriteFunc) Node {
+	nodes := rewriteList([]Node{node}, fn)
+	switch len(nodes) {
+	case 0:
+		return nil
+	case 1:
+		return nodes[0]
+	}
+	return &DocumentNode{NodeList: nodes}
+}
+
+// rewriteList rewrites each of nodes, returning the nodes which take their
+// place
+func rewriteList(nodes []Node, fn RewriteFunc) []Node {
+	result := make([]Node, 0, len(nodes))
+	for _, node := range nodes {
+		replacement, action := fn(node)
+		switch {
+		case action == Delete:
+		case action == InsertBefore || action == InsertAfter:
+			if replacement != nil && action == InsertBefore {
+				result = append(result, replacement)
+			}
+			result = append(result, rewriteChildren(node, fn))
+			if replacement != nil && action == InsertAfter {
+				result = append(result, replacement)
+			}
+		case replacement == nil:
+		case action == Skip:
+			result = append(result, replacement)
+		default:
+			result = append(result, rewriteChildren(replacement, fn))
+		}
+	}
+	return result
+}
+
+// rewriteChildren rewrites the nodes within node, returning node
+func rewriteChildren(node Node, fn RewriteFunc) Node {
+	switch n := node.(type) {
+	case *DocumentNode:
+		n.NodeList = rewriteList(n.NodeList, fn)
+	case *BlockTagNode:
+		if n.Subtree == nil {
+			break
+		}
+		if n.Subtree = Rewrite(n.Subtree, fn); n.Subtree == nil {
+			n.Subtree = &DocumentNode{NodeList: make([]Node, 0)}
+		}
+	}
+	return node
+}
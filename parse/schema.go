@@ -0,0 +1,263 @@
+package parse
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// A ValueType is the type of an argument or attribute described by a
+// TagSchema
+type ValueType int
+
+const (
+	StringValue ValueType = iota // any text
+	BoolValue                    // true or false
+	IntValue                     // an integer
+	FloatValue                   // any number
+)
+
+// valueTypeNames names each ValueType when exported, such as in a Catalog
+var valueTypeNames = map[ValueType]string{
+	StringValue: "string",
+	BoolValue:   "bool",
+	IntValue:    "int",
+	FloatValue:  "float",
+}
+
+func (t ValueType) String() string {
+	if name, ok := valueTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("ValueType(%d)", int(t))
+}
+
+// MarshalText encodes the ValueType as its name, e.g. "int"
+func (t ValueType) MarshalText() ([]byte, error) {
+	if _, ok := valueTypeNames[t]; !ok {
+		return nil, fmt.Errorf("unknown ValueType %d", int(t))
+	}
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText decodes a ValueType from its name
+func (t *ValueType) UnmarshalText(text []byte) error {
+	for valueType, name := range valueTypeNames {
+		if name == string(text) {
+			*t = valueType
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown ValueType %q", text)
+}
+
+// reflectTypes maps each ValueType to the type used to convert it
+var reflectTypes = map[ValueType]reflect.Type{
+	StringValue: reflect.TypeOf(""),
+	BoolValue:   reflect.TypeOf(false),
+	IntValue:    reflect.TypeOf(int64(0)),
+	FloatValue:  reflect.TypeOf(float64(0)),
+}
+
+// A ValueSchema describes a single positional argument or attribute of a
+// Braai tag. A value is optional unless Required is set, and is replaced by
+// Default when it is omitted and Default is not empty. If Enum is not empty,
+// the value must be one of its members. Name and Description are for
+// documentation only.
+type ValueSchema struct {
+	Name        string    `json:"name,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Type        ValueType `json:"type"`
+	Required    bool      `json:"required,omitempty"`
+	Default     string    `json:"default,omitempty"`
+	Enum        []string  `json:"enum,omitempty"`
+}
+
+// check ensures that text is a valid value according to the ValueSchema. A
+// ValueSchema of an unknown ValueType accepts no value.
+func (s ValueSchema) check(text string) error {
+	typ, ok := reflectTypes[s.Type]
+	if !ok {
+		return fmt.Errorf("unknown type %s in schema", s.Type)
+	}
+	if _, err := convert(text, typ); err != nil {
+		return err
+	}
+	if len(s.Enum) == 0 {
+		return nil
+	}
+	for _, member := range s.Enum {
+		if text == member {
+			return nil
+		}
+	}
+	return fmt.Errorf("expected one of %s", strings.Join(s.Enum, ", "))
+}
+
+// A TagSchema describes the dot commands, positional arguments, and
+// attributes accepted by a Braai tag. It is registered with
+// HandlerMux.DefineSchema, enforced by Validate, and used during execution to
+// fill in the defaults of omitted arguments and attributes before the
+// handler is invoked. For example, the schema of
+//   {{gallery.photos(42) size="big"}}
+// could be:
+//   TagSchema{
+//	  DotCommands: []string{"photos"},
+//	  Attributes: map[string]ValueSchema{
+//	    "size": {Enum: []string{"small", "big"}, Default: "small"},
+//	  },
+//	}
+type TagSchema struct {
+	Description string                 // documents the tag for editors
+	DotCommands []string               // the permitted dot commands, nil permits any
+	Arguments   []ValueSchema          // the positional arguments, in order
+	Variadic    bool                   // whether the last argument may be repeated
+	Attributes  map[string]ValueSchema // the permitted attributes
+}
+
+// DefineSchema registers the TagSchema of the Braai tag named ident
+func (h *HandlerMux) DefineSchema(ident string, schema TagSchema) {
+	h.schemas[ident] = &schema
+}
+
+// GetSchema returns the TagSchema previously registered using DefineSchema,
+// or nil if there is none
+func (h *HandlerMux) GetSchema(ident string) *TagSchema {
+	return h.schemas[ident]
+}
+
+// check reports every way in which the BraaiTag does not conform to the
+// TagSchema
+func (s *TagSchema) check(b *BraaiTagNode) (errs []*SchemaError) {
+	report := func(pos Position, format string, args ...interface{}) {
+		errs = append(errs, &SchemaError{Pos: pos, Tag: b.Text, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	if s.DotCommands != nil {
+		for _, cmd := range b.DotCommands {
+			if !contains(s.DotCommands, cmd.Text) {
+				report(cmd.Pos, "Unknown dot command `%s` for %s tag", cmd.Text, b.Text)
+			}
+		}
+	}
+
+	for i, arg := range b.Arguments {
+		pos := b.Pos
+		if i < len(b.ArgumentNodes) {
+			pos = b.ArgumentNodes[i].Pos
+		}
+		argSchema, ok := s.argument(i)
+		if !ok {
+			report(pos, "Too many arguments to %s tag, expected at most %d", b.Text, len(s.Arguments))
+			break
+		}
+		if err := argSchema.check(arg); err != nil {
+			report(pos, "Argument %d %q to %s tag: %s", i+1, arg, b.Text, err)
+		}
+	}
+	for i := len(b.Arguments); i < len(s.Arguments); i++ {
+		if s.Arguments[i].Required {
+			report(b.Pos, "Missing argument %d to %s tag", i+1, b.Text)
+		}
+	}
+
+	keys := make([]string, 0, len(b.Attributes))
+	for key := range b.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		pos, ok := b.AttributePos[key]
+		if !ok {
+			pos = b.Pos
+		}
+		attrSchema, ok := s.Attributes[key]
+		if !ok {
+			report(pos, "Unknown attribute %s for %s tag", key, b.Text)
+			continue
+		}
+		if err := attrSchema.check(b.Attributes[key]); err != nil {
+			report(pos, "Attribute %s=%q to %s tag: %s", key, b.Attributes[key], b.Text, err)
+		}
+	}
+	var required []string
+	for key, attrSchema := range s.Attributes {
+		if _, ok := b.Attributes[key]; attrSchema.Required && !ok {
+			required = append(required, key)
+		}
+	}
+	sort.Strings(required)
+	for _, key := range required {
+		report(b.Pos, "Missing attribute %s for %s tag", key, b.Text)
+	}
+	return errs
+}
+
+// argument returns the ValueSchema of the positional argument at index i
+func (s *TagSchema) argument(i int) (ValueSchema, bool) {
+	if i < len(s.Arguments) {
+		return s.Arguments[i], true
+	}
+	if s.Variadic && len(s.Arguments) > 0 {
+		return s.Arguments[len(s.Arguments)-1], true
+	}
+	return ValueSchema{}, false
+}
+
+// withDefaults returns a copy of the BraaiTag with the defaults of any omitted
+// arguments and attributes filled in, or the BraaiTag itself if nothing was
+// omitted. Only trailing arguments are filled in, since positional arguments
+// cannot be skipped.
+func (s *TagSchema) withDefaults(b *BraaiTagNode) *BraaiTagNode {
+	var args []string
+	for i := len(b.Arguments); i < len(s.Arguments) && s.Arguments[i].Default != ""; i++ {
+		if args == nil {
+			args = append(args, b.Arguments...)
+		}
+		args = append(args, s.Arguments[i].Default)
+	}
+
+	var attrs map[string]string
+	for key, attrSchema := range s.Attributes {
+		if _, ok := b.Attributes[key]; ok || attrSchema.Default == "" {
+			continue
+		}
+		if attrs == nil {
+			attrs = make(map[string]string, len(b.Attributes)+1)
+			for k, v := range b.Attributes {
+				attrs[k] = v
+			}
+		}
+		attrs[key] = attrSchema.Default
+	}
+
+	if args == nil && attrs == nil {
+		return b
+	}
+	tag := *b
+	if args != nil {
+		tag.Arguments = args
+	}
+	if attrs != nil {
+		tag.Attributes = attrs
+	}
+	return &tag
+}
+
+// withDefaults applies the TagSchema registered for the BraaiTag, if any
+func (h *HandlerMux) withDefaults(b *BraaiTagNode) *BraaiTagNode {
+	if schema := h.GetSchema(b.Text); schema != nil {
+		return schema.withDefaults(b)
+	}
+	return b
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package parse
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// A Scope is the environment available to a handler while a single Braai tag
+// is executed. Environments are scoped lexically to a tag: the Env is first
+// seeded from the tag's attributes, and is then transformed by the tag's dot
+// commands in a right-to-left fashion. Consequently, dot commands are able to
+// override attributes.
+type Scope struct {
+	Tag       string            // the identifier of the tag being executed
+	Arguments []string          // positional arguments to the tag
+	Argument  string            // the argument of the dot command being applied, if any
+	Env       map[string]string // the environment of the tag
+}
+
+// A ScopeHandlerFunc receives the final Scope of a Braai tag, and is
+// responsible for producing the output of the tag regardless of any previous
+// alterations to the environment
+type ScopeHandlerFunc func(Scope) (string, error)
+
+// A DotHandlerFunc transforms the Scope of a Braai tag when the dot command it
+// was registered for is present on the tag
+type DotHandlerFunc func(Scope) Scope
+
+// HandleScope registers a ScopeHandlerFunc with this HandlerMux. The handler
+// will be invoked with the environment produced by Scope.
+func (h *HandlerMux) HandleScope(ident string, f ScopeHandlerFunc) {
+	h.registrations[ident] = registration{scoped: true}
+	h.funcs[ident] = HandlerFunc(func(b *BraaiTagNode) (string, error) {
+		scope, err := h.Scope(b)
+		if err != nil {
+			return "", err
+		}
+		return f(scope)
+	})
+}
+
+// HandleSafeScope is like HandleScope, but the output of f is trusted markup
+// which is never escaped
+func (h *HandlerMux) HandleSafeScope(ident string, f func(Scope) (SafeHTML, error)) {
+	h.HandleSafeFunc(ident, func(b *BraaiTagNode) (SafeHTML, error) {
+		scope, err := h.Scope(b)
+		if err != nil {
+			return "", err
+		}
+		return f(scope)
+	})
+	h.registrations[ident] = registration{scoped: true, escaped: true}
+}
+
+// HandleContextScope registers a ContextHandlerFunc which invokes f with the
+// Context and the environment produced by Scope
+func (h *HandlerMux) HandleContextScope(ident string, f func(context.Context, Scope) (string, error)) {
+	h.HandleContextFunc(ident, func(ctx context.Context, b *BraaiTagNode) (string, error) {
+		scope, err := h.Scope(b)
+		if err != nil {
+			return "", err
+		}
+		return f(ctx, scope)
+	})
+	h.ctxRegs[ident] = registration{scoped: true}
+}
+
+// HandleStreamScope registers a StreamHandlerFunc which invokes f with the
+// Context, the Writer and the environment produced by Scope
+func (h *HandlerMux) HandleStreamScope(ident string, f func(context.Context, io.Writer, Scope) error) {
+	h.HandleStreamFunc(ident, func(ctx context.Context, w io.Writer, b *BraaiTagNode) error {
+		scope, err := h.Scope(b)
+		if err != nil {
+			return err
+		}
+		return f(ctx, w, scope)
+	})
+	h.streamRegs[ident] = registration{scoped: true}
+}
+
+// DefaultScopeHandler registers a default handler which invokes f with the
+// environment produced by Scope
+func (h *HandlerMux) DefaultScopeHandler(f ScopeHandlerFunc) {
+	h.DefaultHandler(func(b *BraaiTagNode) (string, error) {
+		scope, err := h.Scope(b)
+		if err != nil {
+			return "", err
+		}
+		return f(scope)
+	})
+	h.defaultReg = registration{scoped: true}
+}
+
+// HandleDot registers a DotHandlerFunc for the dot command named name. Dot
+// handlers are shared by every tag executed with this HandlerMux.
+func (h *HandlerMux) HandleDot(name string, f DotHandlerFunc) {
+	h.dotFuncs[name] = f
+}
+
+// GetDot returns a DotHandlerFunc previously defined using HandleDot
+func (h *HandlerMux) GetDot(name string) DotHandlerFunc {
+	return h.dotFuncs[name]
+}
+
+// Scope builds the environment for a Braai tag. The Env is seeded with the
+// tag's attributes, and then every dot command, starting with the right-most
+// one, is applied to it using the registered DotHandlerFuncs.
+func (h *HandlerMux) Scope(b *BraaiTagNode) (Scope, error) {
+	scope := Scope{
+		Tag:       b.Text,
+		Arguments: b.Arguments,
+		Env:       make(map[string]string, len(b.Attributes)),
+	}
+	for key, value := range b.Attributes {
+		scope.Env[key] = value
+	}
+
+	for i := len(b.DotCommands) - 1; i >= 0; i-- {
+		cmd := b.DotCommands[i]
+		dot := h.GetDot(cmd.Text)
+		if dot == nil {
+			return scope, undefinedDot(cmd.Text, b.Text)
+		}
+		if arg, ok := cmd.Argument.(*SingleArgumentNode); ok {
+			scope.Argument = arg.Text
+		}
+		scope = dot(scope)
+		scope.Argument = ""
+	}
+	return scope, nil
+}
+
+// undefinedDot reports a dot command without a DotHandlerFunc
+func undefinedDot(cmd, tag string) error {
+	return fmt.Errorf("Dot handler not defined for `%s` in %s tag", cmd, tag)
+}
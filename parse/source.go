@@ -0,0 +1,147 @@
+package parse
+
+import (
+	"strings"
+	"unicode"
+)
+
+// A Source holds the text from which a Node was parsed by a lossless Tree,
+// including its trivia: the text which is part of the document but not of
+// the AST, such as escape characters, the opener and closer of a raw section,
+// and whitespace removed by trim markers. Trivia is attributed to the node
+// which caused it, so that it disappears along with the node.
+//
+// While a node is unmodified, the Printer reproduces it from its Source. Once
+// it is modified, its canonical form is printed instead. The trivia of a
+// modified BraaiTagNode or BlockTagNode is retained, as are the delimiters,
+// trim markers and spacing of its tags, so that only their contents change.
+// Modifications to a BlockTagNode's Subtree, or to a DocumentNode's NodeList,
+// only affect the nodes within them.
+type Source struct {
+	Leading  string // trivia preceding the node
+	Text     string // the source of the node itself, or the opener of a block tag
+	Closer   string // the closer of a block tag, including any whitespace it trims
+	Trailing string // trivia following the node, or the last node of a document
+
+	canonical string // the canonical form of the node when it was parsed
+	left      string // the delimiters of the source
+	right     string
+}
+
+// sourceOf returns the Source of node, or nil if it has none
+func sourceOf(node Node) *Source {
+	switch n := node.(type) {
+	case *DocumentNode:
+		return n.Source
+	case *TextNode:
+		return n.Source
+	case *CommentNode:
+		return n.Source
+	case *BraaiTagNode:
+		return n.Source
+	case *BlockTagNode:
+		return n.Source
+	case *ErrorNode:
+		return n.Source
+	}
+	return nil
+}
+
+// retainSource records the Source of d and of every node within it. When d is
+// the Subtree of a block tag, head and tail are the opener and closer of the
+// block, which take any whitespace trimmed by their trim markers.
+func (t *Tree) retainSource(d *DocumentNode, head, tail *string) {
+	input := t.lines.input
+	d.Source = t.newSource(d)
+	prevTrailing, prevTrims := head, head != nil && t.trimsRight(*head)
+	offset := d.Pos.Offset
+	for _, node := range d.NodeList {
+		var pos Position
+		tag := true // whether the node may have trim markers
+		src := t.newSource(node)
+		switch n := node.(type) {
+		case *TextNode:
+			n.Source, pos, tag = src, n.Pos, false
+		case *CommentNode:
+			n.Source, pos, tag = src, n.Pos, false
+		case *BraaiTagNode:
+			n.Source, pos = src, n.Pos
+		case *BlockTagNode:
+			n.Source, pos = src, n.Pos
+		case *ErrorNode:
+			n.Source, pos = src, n.Pos
+		default:
+			continue
+		}
+		src.Text = input[pos.Offset:pos.End]
+
+		trailing, middle, leading := t.splitTrivia(input[offset:pos.Offset], prevTrims, tag && t.trimsLeft(src.Text))
+		if prevTrailing != nil {
+			*prevTrailing += trailing
+		} else {
+			middle = trailing + middle
+		}
+		src.Leading = middle + leading
+
+		end := src.Text
+		if block, ok := node.(*BlockTagNode); ok {
+			if subtree, ok := block.Subtree.(*DocumentNode); ok {
+				src.Text = input[pos.Offset:subtree.Pos.Offset]
+				src.Closer = input[subtree.Pos.End:pos.End]
+				end = src.Closer
+				t.retainSource(subtree, &src.Text, &src.Closer)
+			}
+		}
+		prevTrailing, prevTrims = &src.Trailing, tag && t.trimsRight(end)
+		offset = pos.End
+	}
+
+	trailing, middle, leading := t.splitTrivia(input[offset:d.Pos.End], prevTrims, tail != nil && t.trimsLeft(*tail))
+	if prevTrailing != nil {
+		*prevTrailing += trailing
+	} else {
+		middle = trailing + middle
+	}
+	d.Source.Trailing = middle
+	if tail != nil {
+		*tail = leading + *tail
+	} else {
+		d.Source.Trailing += leading
+	}
+}
+
+// newSource returns a Source recording the canonical form of node
+func (t *Tree) newSource(node Node) *Source {
+	p := &printer{left: t.lexer.leftDelim, right: t.lexer.rightDelim}
+	return &Source{canonical: p.shallow(node), left: p.left, right: p.right}
+}
+
+// splitTrivia divides the trivia between two nodes into that following the
+// first node, which is any whitespace it trims and the closer of a raw
+// section, and that preceding the second node, which is any whitespace it
+// trims. Whatever remains in the middle, such as an escape character or the
+// opener of a raw section, also precedes the second node.
+func (t *Tree) splitTrivia(gap string, prevTrims, nextTrims bool) (trailing, middle, leading string) {
+	if prevTrims {
+		rest := strings.TrimLeftFunc(gap, unicode.IsSpace)
+		trailing, gap = gap[:len(gap)-len(rest)], rest
+	}
+	if closer := t.lexer.rawCloser(); strings.HasPrefix(gap, closer) {
+		trailing, gap = trailing+closer, gap[len(closer):]
+	}
+	if nextTrims {
+		rest := strings.TrimRightFunc(gap, unicode.IsSpace)
+		gap, leading = rest, gap[len(rest):]
+	}
+	return trailing, gap, leading
+}
+
+// trimsLeft reports whether the source of a tag begins with a trim marker
+func (t *Tree) trimsLeft(src string) bool {
+	return strings.HasPrefix(src, t.lexer.leftDelim+trimMarker)
+}
+
+// trimsRight reports whether the source of a tag ends with a trim marker
+func (t *Tree) trimsRight(src string) bool {
+	return strings.HasSuffix(src, trimMarker+t.lexer.rightDelim)
+}
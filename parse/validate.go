@@ -0,0 +1,140 @@
+package parse
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+)
+
+// Validate checks every tag within node against the handlers registered with
+// mux, without executing any of them. It reports tags and block tags without
+// a handler, dot commands which the handler of a tag cannot process, and
+// arguments or attributes which cannot be bound to a handler registered with
+// Handle. The problems are returned as an ErrorList, in document order, of the
+// same errors Execute would return. Validate returns nil if no problems are
+// found.
+//
+// Tags with a TagSchema registered using DefineSchema are also checked against
+// it first, reporting a SchemaError for each problem, and are only checked
+// against their handler if they conform to it. Dot commands are checked
+// against the registered DotHandlerFuncs for tags handled by HandleScope or
+// its variants, such as HandleContextScope and DefaultScopeHandler. Otherwise,
+// tags handled by functions receiving the raw BraaiTagNode, such as those
+// registered with HandleFunc, can only be checked for the presence of a
+// handler.
+func Validate(node Node, mux *HandlerMux) error {
+	v := &validator{mux: mux}
+	node.Visit(v)
+	if len(v.problems) == 0 {
+		return nil
+	}
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		return v.problems[i].pos.Offset < v.problems[j].pos.Offset
+	})
+	errs := make(ErrorList, 0, len(v.problems))
+	for _, p := range v.problems {
+		errs = append(errs, p.err)
+	}
+	return errs
+}
+
+// A validator is the Visitor used by Validate to collect problems
+type validator struct {
+	mux      *HandlerMux
+	problems []problem
+}
+
+// A problem is an error found by Validate, along with its position
+type problem struct {
+	pos Position
+	err error
+}
+
+func (v *validator) report(pos Position, err error) {
+	v.problems = append(v.problems, problem{pos, err})
+}
+
+// AcceptTag checks the BraaiTag against its schema and handler
+func (v *validator) AcceptTag(b *BraaiTagNode) {
+	mux := v.mux
+	if mux.Get(b.Text) == nil && mux.GetContext(b.Text) == nil && mux.GetStream(b.Text) == nil && mux.GetDefaultHandler() == nil {
+		v.report(b.Pos, &UndefinedHandlerError{Pos: b.Pos, Tag: b.Text})
+		return
+	}
+	if schema := mux.GetSchema(b.Text); schema != nil {
+		if errs := schema.check(b); len(errs) > 0 {
+			for _, err := range errs {
+				v.report(err.Pos, err)
+			}
+			return
+		}
+		b = schema.withDefaults(b)
+	}
+
+	reg := mux.registration(b.Text)
+	var err error
+	switch {
+	case reg.scoped:
+		for _, cmd := range b.DotCommands {
+			if mux.GetDot(cmd.Text) == nil {
+				err = undefinedDot(cmd.Text, b.Text)
+				break
+			}
+		}
+	case reg.reflected != nil:
+		err = checkReflected(b, reg.reflected)
+	}
+	if err != nil {
+		var handlerErr *HandlerError
+		if !errors.As(err, &handlerErr) {
+			handlerErr = &HandlerError{Pos: b.Pos, Tag: b.Text, Err: err}
+		}
+		v.report(handlerErr.Pos, handlerErr)
+	}
+}
+
+// AcceptBlockTag checks that the BlockTag has a handler
+func (v *validator) AcceptBlockTag(b *BlockTagNode) {
+	mux := v.mux
+	if mux.GetBlock(b.Name) == nil && mux.GetBlockContext(b.Name) == nil && mux.GetBlockStream(b.Name) == nil {
+		v.report(b.Pos, &UndefinedHandlerError{Pos: b.Pos, Tag: b.Name, Block: true})
+	}
+}
+
+// AcceptTextNode is a no-op, since text is always valid
+func (v *validator) AcceptTextNode(t *TextNode) {
+	// NOP
+}
+
+// checkReflected follows the dot commands of the BraaiTag through the methods
+// of handler, as the HandlerFunc defined by Handle would. Once a method
+// returns an interface, the remaining methods depend on the value returned,
+// so they are left unchecked unless the interface declares them.
+func checkReflected(b *BraaiTagNode, handler interface{}) error {
+	typ := reflect.TypeOf(handler)
+	if typ == nil {
+		return nil
+	}
+	if len(b.DotCommands) == 0 {
+		if typ.Kind() == reflect.Func {
+			return check(b, b.Text, typ, nil, true)
+		}
+		return nil
+	}
+	for idx, cmd := range b.DotCommands {
+		name := methodName(cmd.Text)
+		fnType, ok := methodType(typ, name)
+		if !ok {
+			if typ.Kind() == reflect.Interface {
+				return nil
+			}
+			return undefinedMethod(name, b.Text)
+		}
+		arg, _ := cmd.Argument.(*SingleArgumentNode)
+		if err := check(b, name, fnType, arg, idx == len(b.DotCommands)-1); err != nil {
+			return err
+		}
+		typ = fnType.Out(0)
+	}
+	return nil
+}
@@ -3,14 +3,71 @@ package parse
 // A CompositeVisitor takes an arbitrary number of Visitors and invokes their
 // corresponding Accept methods when its Accept methods are invoked. This
 // allows for one traversal of a Brush AST with an arbitrary number of Visitors.
+//
+// A CompositeVisitor is also a Walker, so it can be passed to Walk. Visitors
+// which are also Walkers then have their Enter and Leave methods invoked, and
+// other Visitors have their Accept methods invoked as each node is left.
+// Walkers which are not Visitors can be added using AddWalker.
 type CompositeVisitor struct {
 	visitors []Visitor
+	walkers  []Walker // every Visitor and added Walker, as a Walker
+	skipped  []int    // for each Walker, the depth of the node whose children it skipped
 }
 
 // Takes a variadic list of Visitors to allow for easy creation of
 // CompositeVisitors.
 func NewCompositeVisitor(visitors ...Visitor) *CompositeVisitor {
-	return &CompositeVisitor{visitors}
+	cv := &CompositeVisitor{visitors: visitors}
+	for _, visitor := range visitors {
+		if walker, ok := visitor.(Walker); ok {
+			cv.AddWalker(walker)
+		} else {
+			cv.AddWalker(visitorWalker{visitor})
+		}
+	}
+	return cv
+}
+
+// AddWalker adds a Walker which is only notified when the CompositeVisitor is
+// passed to Walk, returning the CompositeVisitor so that calls can be
+// chained
+func (cv *CompositeVisitor) AddWalker(w Walker) *CompositeVisitor {
+	cv.walkers = append(cv.walkers, w)
+	cv.skipped = append(cv.skipped, 0)
+	return cv
+}
+
+// Enter invokes the Enter method of every Walker which has not skipped the
+// nodes containing node. The nodes within node are skipped once every Walker
+// has skipped them.
+func (cv *CompositeVisitor) Enter(node Node, ancestors []Node) bool {
+	depth := len(ancestors) + 1
+	enter := false
+	for i, walker := range cv.walkers {
+		if cv.skipped[i] != 0 {
+			continue
+		}
+		if walker.Enter(node, ancestors) {
+			enter = true
+		} else {
+			cv.skipped[i] = depth
+		}
+	}
+	return enter
+}
+
+// Leave invokes the Leave method of every Walker which entered node
+func (cv *CompositeVisitor) Leave(node Node, ancestors []Node) {
+	depth := len(ancestors) + 1
+	for i, walker := range cv.walkers {
+		if cv.skipped[i] != 0 && cv.skipped[i] < depth {
+			continue
+		}
+		walker.Leave(node, ancestors)
+		if cv.skipped[i] == depth {
+			cv.skipped[i] = 0
+		}
+	}
 }
 
 // Accepts BraaiTagNodes and dispatches to the corresponding AcceptTag method
@@ -36,3 +93,13 @@ func (cv *CompositeVisitor) AcceptTextNode(b *TextNode) {
 		visitor.AcceptTextNode(b)
 	}
 }
+
+// Accepts CommentNodes and dispatches to the corresponding AcceptComment
+// method of any visitors in the internal list which are CommentVisitors.
+func (cv *CompositeVisitor) AcceptComment(c *CommentNode) {
+	for _, visitor := range cv.visitors {
+		if commentVisitor, ok := visitor.(CommentVisitor); ok {
+			commentVisitor.AcceptComment(c)
+		}
+	}
+}
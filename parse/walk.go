@@ -0,0 +1,100 @@
+package parse
+
+// A Walker is notified as Walk enters and leaves every Node of a Brush AST.
+// Unlike a Visitor, it sees each node before and after the nodes within it,
+// including DocumentNodes, DotCommandNodes and SingleArgumentNodes, and knows
+// the ancestors of the node it is given.
+type Walker interface {
+	// Enter is called before the nodes within node are walked, which are
+	// skipped if Enter returns false. The ancestors of node are listed from
+	// the root of the AST down to its parent, and must be copied if they are
+	// to be retained.
+	Enter(node Node, ancestors []Node) bool
+	// Leave is called after the nodes within node have been walked, or
+	// skipped, with the same ancestors as Enter
+	Leave(node Node, ancestors []Node)
+}
+
+// Walk traverses the AST rooted at node in document order, calling the Enter
+// and Leave methods of w for every Node. The nodes within each kind of Node
+// are:
+//   DocumentNode:   its NodeList
+//   BlockTagNode:   its Subtree
+//   BraaiTagNode:   its ArgumentNodes and DotCommands, in the order they appear
+//   DotCommandNode: its Argument, if any
+func Walk(node Node, w Walker) {
+	(&walk{walker: w}).node(node)
+}
+
+// walk holds the state of a single call to Walk
+type walk struct {
+	walker    Walker
+	ancestors []Node
+}
+
+func (w *walk) node(node Node) {
+	if w.walker.Enter(node, w.ancestors) {
+		w.ancestors = append(w.ancestors, node)
+		for _, child := range children(node) {
+			w.node(child)
+		}
+		w.ancestors = w.ancestors[:len(w.ancestors)-1]
+	}
+	w.walker.Leave(node, w.ancestors)
+}
+
+// children returns the nodes within node, in the order they appear
+func children(node Node) []Node {
+	var nodes []Node
+	switch n := node.(type) {
+	case *DocumentNode:
+		return n.NodeList
+	case *BlockTagNode:
+		if n.Subtree != nil {
+			nodes = append(nodes, n.Subtree)
+		}
+	case *BraaiTagNode:
+		args := n.ArgumentNodes
+		if n.CommandArgument && len(args) > 0 {
+			nodes, args = append(nodes, args[0]), args[1:]
+		}
+		for i := range n.DotCommands {
+			nodes = append(nodes, &n.DotCommands[i])
+		}
+		for _, arg := range args {
+			nodes = append(nodes, arg)
+		}
+	case *DotCommandNode:
+		if n.Argument != nil {
+			nodes = append(nodes, n.Argument)
+		}
+	}
+	return nodes
+}
+
+// visitorWalker adapts a Visitor to the Walker interface. Its Accept methods
+// are called as each node is left, matching the order of Node.Visit.
+type visitorWalker struct {
+	Visitor
+}
+
+// Enter walks the nodes within every node
+func (v visitorWalker) Enter(node Node, ancestors []Node) bool {
+	return true
+}
+
+// Leave invokes the Accept method corresponding to node, if any
+func (v visitorWalker) Leave(node Node, ancestors []Node) {
+	switch n := node.(type) {
+	case *BraaiTagNode:
+		v.AcceptTag(n)
+	case *BlockTagNode:
+		v.AcceptBlockTag(n)
+	case *TextNode:
+		v.AcceptTextNode(n)
+	case *CommentNode:
+		if cv, ok := v.Visitor.(CommentVisitor); ok {
+			cv.AcceptComment(n)
+		}
+	}
+}